@@ -0,0 +1,375 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+const defaultChangeFeedBufferSize = 1000
+const changeSubscriberBufferSize = 256
+const sseHeartbeat = 15 * time.Second
+
+const changesTable = "temp.ws4sqlite_changes"
+
+// The change feed of a database publishes the inserts, updates and deletes
+// that are committed through the web service and the scheduled tasks.
+//
+// SQLite has an update hook, but it's not available from Go; so, for each
+// table, some TEMP triggers on the (only) connection record the changes in
+// a TEMP table. They are part of the transaction, so what is rolled back,
+// even by a failed statement, disappears. Before committing, the recorded
+// changes are collected, and after the commit they are published.
+//
+// The last changes are kept in a buffer, so that a client that reconnects
+// can resume from the last event it received.
+type changeFeed struct {
+	Mutex         sync.Mutex
+	Buffer        []changeEvent // a ring, Next is the position to write to
+	Next          int
+	LastId        uint64
+	Subscribers   map[*changeSubscriber]bool
+	SchemaVersion int64 // of the main schema, when the triggers were created
+}
+
+type changeSubscriber struct {
+	Tables map[string]bool // lowercase; if empty, all the tables
+	Ch     chan changeEvent
+}
+
+// An execQuerier is a transaction or a connection
+type execQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// Creates the feed and its TEMP objects on the connection of the database
+func newChangeFeed(db *db) (*changeFeed, error) {
+	ret := &changeFeed{
+		Buffer: make([]changeEvent, 0, db.ChangeFeedBufferSize),
+		// The IDs keep growing across restarts, so that a client that
+		// resumes from an ID of a previous run gets a reset.
+		LastId:        uint64(time.Now().UnixMilli()) * 1000,
+		Subscribers:   make(map[*changeSubscriber]bool),
+		SchemaVersion: -1,
+	}
+
+	if _, err := db.DbConn.ExecContext(context.Background(), "CREATE TEMP TABLE IF NOT EXISTS ws4sqlite_changes (seq INTEGER PRIMARY KEY, tbl TEXT, op TEXT, rid INTEGER)"); err != nil {
+		return nil, err
+	}
+
+	if err := ret.syncTriggers(db.DbConn); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func quoteIdent(ident string) string {
+	return "\"" + strings.ReplaceAll(ident, "\"", "\"\"") + "\""
+}
+
+func quoteLiteral(lit string) string {
+	return "'" + strings.ReplaceAll(lit, "'", "''") + "'"
+}
+
+// Creates the triggers for the tables that don't have them yet, if the schema
+// changed. Tables without a rowid are not supported. The caller must hold the
+// mutex of the database.
+func (cf *changeFeed) syncTriggers(conn *sql.Conn) error {
+	var schemaVersion int64
+	if err := conn.QueryRowContext(context.Background(), "PRAGMA main.schema_version").Scan(&schemaVersion); err != nil {
+		return err
+	}
+	if schemaVersion == cf.SchemaVersion {
+		return nil
+	}
+
+	rows, err := conn.QueryContext(context.Background(), "SELECT name FROM pragma_table_list WHERE schema = 'main' AND type = 'table' AND wr = 0 AND name NOT LIKE 'sqlite\\_%' ESCAPE '\\' AND name NOT LIKE '\\_ws4sqlite\\_%' ESCAPE '\\'")
+	if err != nil {
+		return err
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		for _, op := range []string{"insert", "update", "delete"} {
+			row := "NEW"
+			if op == "delete" {
+				row = "OLD"
+			}
+			sql := fmt.Sprintf(
+				// Names can't be qualified inside a trigger, but the TEMP schema comes first
+				"CREATE TEMP TRIGGER IF NOT EXISTS %s AFTER %s ON main.%s BEGIN INSERT INTO ws4sqlite_changes (tbl, op, rid) VALUES (%s, '%s', %s.rowid); END",
+				quoteIdent("ws4sqlite_"+op+"_"+table), strings.ToUpper(op), quoteIdent(table), quoteLiteral(table), op, row)
+			if _, err := conn.ExecContext(context.Background(), sql); err != nil {
+				return err
+			}
+		}
+	}
+
+	cf.SchemaVersion = schemaVersion
+	return nil
+}
+
+// Collects (and removes) the changes recorded by the triggers. If called in a
+// transaction, they must be published only after the commit.
+func (cf *changeFeed) collect(ctx context.Context, eq execQuerier) ([]changeEvent, error) {
+	rows, err := eq.QueryContext(ctx, "SELECT tbl, op, rid FROM "+changesTable+" ORDER BY seq")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret []changeEvent
+	for rows.Next() {
+		var ce changeEvent
+		if err := rows.Scan(&ce.Table, &ce.Op, &ce.RowId); err != nil {
+			return nil, err
+		}
+		ret = append(ret, ce)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ret) > 0 {
+		if _, err := eq.ExecContext(ctx, "DELETE FROM "+changesTable); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// Assigns the IDs to the changes, adds them to the buffer and sends them to
+// the subscribers. A subscriber that doesn't keep up is dropped, it can resume
+// with the ID of the last event it received.
+func (cf *changeFeed) publish(changes []changeEvent) {
+	cf.Mutex.Lock()
+	defer cf.Mutex.Unlock()
+
+	for _, ce := range changes {
+		cf.LastId++
+		ce.Id = cf.LastId
+
+		if len(cf.Buffer) < cap(cf.Buffer) {
+			cf.Buffer = append(cf.Buffer, ce)
+		} else {
+			cf.Buffer[cf.Next] = ce
+		}
+		cf.Next = (cf.Next + 1) % cap(cf.Buffer)
+
+		for sub := range cf.Subscribers {
+			if !sub.wants(ce) {
+				continue
+			}
+			select {
+			case sub.Ch <- ce:
+			default:
+				mllog.Warnf("change feed subscriber too slow, dropping it")
+				cf.drop(sub)
+			}
+		}
+	}
+}
+
+func (sub *changeSubscriber) wants(ce changeEvent) bool {
+	return len(sub.Tables) == 0 || sub.Tables[strings.ToLower(ce.Table)]
+}
+
+// Registers a subscriber. If a last event ID is given, returns the buffered
+// events after it; if some of them are not in the buffer anymore, reports
+// a gap, and the client should reload its data.
+func (cf *changeFeed) subscribe(tables []string, lastId *uint64) (sub *changeSubscriber, backlog []changeEvent, gap bool) {
+	sub = &changeSubscriber{Tables: make(map[string]bool), Ch: make(chan changeEvent, changeSubscriberBufferSize)}
+	for _, table := range tables {
+		if table = strings.TrimSpace(table); table != "" {
+			sub.Tables[strings.ToLower(table)] = true
+		}
+	}
+
+	cf.Mutex.Lock()
+	defer cf.Mutex.Unlock()
+
+	if lastId != nil && *lastId < cf.LastId {
+		// The buffer, from the oldest event
+		ordered := append(append([]changeEvent{}, cf.Buffer[cf.Next:]...), cf.Buffer[:cf.Next]...)
+
+		gap = len(ordered) == 0 || ordered[0].Id > *lastId+1
+		for _, ce := range ordered {
+			if ce.Id > *lastId && sub.wants(ce) {
+				backlog = append(backlog, ce)
+			}
+		}
+	}
+
+	cf.Subscribers[sub] = true
+	return sub, backlog, gap
+}
+
+func (cf *changeFeed) unsubscribe(sub *changeSubscriber) {
+	cf.Mutex.Lock()
+	defer cf.Mutex.Unlock()
+
+	cf.drop(sub)
+}
+
+// The caller must hold the mutex of the feed
+func (cf *changeFeed) drop(sub *changeSubscriber) {
+	if cf.Subscribers[sub] {
+		delete(cf.Subscribers, sub)
+		close(sub.Ch)
+	}
+}
+
+// Publishes the changes made outside a transaction, e.g. by a scheduled task.
+// The caller must hold the mutex of the database.
+func publishAutocommitChanges(db *db) {
+	changes, err := db.ChangeFeed.collect(context.Background(), db.DbConn)
+	if err != nil {
+		mllog.Errorf("in collecting the changes of '%s': %s", db.Id, err.Error())
+		return
+	}
+	db.ChangeFeed.publish(changes)
+
+	if err := db.ChangeFeed.syncTriggers(db.DbConn); err != nil {
+		mllog.Errorf("in creating the change triggers of '%s': %s", db.Id, err.Error())
+	}
+}
+
+func writeSSE(w *bufio.Writer, ce changeEvent) error {
+	data, err := json.Marshal(ce)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "id: %d\nevent: change\ndata: %s\n\n", ce.Id, data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Handler for the Server-Sent Events stream of the changes. The tables can be
+// filtered with the "tables" query parameter (comma separated); to resume, the
+// last event ID is taken from the Last-Event-ID header (that browsers send when
+// reconnecting) or the "lastEventId" query parameter.
+func eventsHandler(databaseId string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		db, err := lookupDb(databaseId)
+		if err != nil {
+			return err
+		}
+
+		if err := lockDb(&db); err != nil {
+			return err
+		}
+		err = ckInlineAuthHeader(&db, c)
+		db.Mutex.Unlock()
+		if err != nil {
+			return err
+		}
+
+		var lastId *uint64
+		lastIdStr := c.Get("Last-Event-ID")
+		if lastIdStr == "" {
+			lastIdStr = c.Query("lastEventId")
+		}
+		if lastIdStr != "" {
+			id, err := strconv.ParseUint(lastIdStr, 10, 64)
+			if err != nil {
+				return newWSErrorf(-1, fiber.StatusBadRequest, "invalid last event ID '%s'", lastIdStr)
+			}
+			lastId = &id
+		}
+
+		var tables []string
+		if c.Query("tables") != "" {
+			tables = strings.Split(c.Query("tables"), ",")
+		}
+
+		sub, backlog, gap := db.ChangeFeed.subscribe(tables, lastId)
+
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer db.ChangeFeed.unsubscribe(sub)
+
+			// Something must be written, for the headers to be sent
+			if _, err := w.WriteString(": connected\n\n"); err != nil {
+				return
+			}
+			if gap {
+				if _, err := w.WriteString("event: reset\ndata: {}\n\n"); err != nil {
+					return
+				}
+			}
+			for _, ce := range backlog {
+				if err := writeSSE(w, ce); err != nil {
+					return
+				}
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+
+			// The pings detect when the client goes away
+			ticker := time.NewTicker(sseHeartbeat)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case ce, ok := <-sub.Ch:
+					if !ok {
+						return
+					}
+					if err := writeSSE(w, ce); err != nil {
+						return
+					}
+				case <-ticker.C:
+					if _, err := w.WriteString(": ping\n\n"); err != nil {
+						return
+					}
+					if err := w.Flush(); err != nil {
+						return
+					}
+				}
+			}
+		})
+		return nil
+	}
+}
@@ -0,0 +1,281 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Drops all the subscribers, ending their streams, so that the server can be
+// shut down; called only by tests, so it fits better here
+func stopChangeFeeds() {
+	for i := range dbs {
+		if cf := dbs[i].ChangeFeed; cf != nil {
+			cf.Mutex.Lock()
+			for sub := range cf.Subscribers {
+				cf.drop(sub)
+			}
+			cf.Mutex.Unlock()
+		}
+	}
+}
+
+// Connects to the SSE stream and sends the events to the channel; a reset
+// is sent as an event with op "reset"
+func sseConnect(query string, t *testing.T) (*http.Response, chan changeEvent) {
+	resp, err := http.Get("http://localhost:12321/feed/events" + query)
+	if err != nil || resp.StatusCode != 200 {
+		t.Error("could not connect to the stream")
+		return nil, nil
+	}
+
+	ch := make(chan changeEvent, 100)
+	go func() {
+		defer close(ch)
+		scanner := bufio.NewScanner(resp.Body)
+		event := ""
+		for scanner.Scan() {
+			line := scanner.Text()
+			if ev, found := strings.CutPrefix(line, "event: "); found {
+				event = ev
+			} else if data, found := strings.CutPrefix(line, "data: "); found {
+				var ce changeEvent
+				if event == "reset" {
+					ce.Op = "reset"
+				} else if err := json.Unmarshal([]byte(data), &ce); err != nil {
+					return
+				}
+				ch <- ce
+			}
+		}
+	}()
+	return resp, ch
+}
+
+func sseNext(ch chan changeEvent, t *testing.T) *changeEvent {
+	select {
+	case ce, ok := <-ch:
+		if ok {
+			return &ce
+		}
+	case <-time.After(2 * time.Second):
+	}
+	t.Error("no event received")
+	return nil
+}
+
+func sseNone(ch chan changeEvent, t *testing.T) {
+	select {
+	case ce := <-ch:
+		t.Error("unexpected event:", ce)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestChangeFeedSetup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:                   "feed",
+				Path:                 ":memory:",
+				EnableChangeFeed:     true,
+				ChangeFeedBufferSize: 5,
+				WebSocket:            true,
+				InitStatements: []string{
+					"CREATE TABLE T (ID INT PRIMARY KEY, VAL TEXT)",
+					"CREATE TABLE U (ID INT PRIMARY KEY)",
+				},
+			},
+			{
+				Id:   "nofeed",
+				Path: ":memory:",
+			},
+		},
+	}
+	// Keep alive is needed by the WebSocket, see TestWSSetup
+	go launch(cfg, false)
+
+	time.Sleep(time.Second)
+}
+
+var firstEventId uint64
+
+func TestChangeFeedEvents(t *testing.T) {
+	resp, ch := sseConnect("?tables=t", t)
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	code, _, _ := call("feed", request{Transaction: []requestItem{
+		{Statement: "INSERT INTO T VALUES (1, 'ONE')"},
+		{Statement: "INSERT INTO U VALUES (1)"},
+		{Statement: "UPDATE T SET VAL = 'UNO' WHERE ID = 1"},
+		{Statement: "INSERT INTO T VALUES (1, 'ONE')", NoFail: true}, // fails, no event
+		{Statement: "DELETE FROM T WHERE ID = 1"},
+	}}, t)
+	if code != 200 {
+		t.Error("request failed")
+		return
+	}
+
+	for _, op := range []string{"insert", "update", "delete"} {
+		ce := sseNext(ch, t)
+		if ce == nil {
+			return
+		}
+		if ce.Table != "T" || ce.Op != op || ce.RowId != 1 {
+			t.Error("wrong event:", *ce)
+			return
+		}
+		if firstEventId == 0 {
+			firstEventId = ce.Id
+		}
+	}
+
+	// U is filtered out, so nothing more
+	sseNone(ch, t)
+
+	// A failed transaction doesn't emit events
+	code, _, _ = call("feed", request{Transaction: []requestItem{
+		{Statement: "INSERT INTO T VALUES (2, 'TWO')"},
+		{Statement: "INSERT INTO NOPE VALUES (2)"},
+	}}, t)
+	if code != 500 {
+		t.Error("request didn't fail")
+		return
+	}
+	sseNone(ch, t)
+}
+
+func TestChangeFeedNewTable(t *testing.T) {
+	resp, ch := sseConnect("", t)
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	code, _, _ := call("feed", request{Transaction: []requestItem{{Statement: "CREATE TABLE V (ID INT)"}}}, t)
+	if code != 200 {
+		t.Error("create failed")
+		return
+	}
+	code, _, _ = call("feed", request{Transaction: []requestItem{{Statement: "INSERT INTO V VALUES (1)"}}}, t)
+	if code != 200 {
+		t.Error("insert failed")
+		return
+	}
+
+	if ce := sseNext(ch, t); ce != nil && (ce.Table != "V" || ce.Op != "insert") {
+		t.Error("wrong event:", *ce)
+	}
+}
+
+func TestChangeFeedResume(t *testing.T) {
+	// From the first event of TestChangeFeedEvents, the following one is the insert in U
+	resp, ch := sseConnect("?lastEventId="+strconv.FormatUint(firstEventId, 10), t)
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	ce := sseNext(ch, t)
+	if ce == nil || ce.Id != firstEventId+1 || ce.Table != "U" {
+		t.Error("wrong resumed event")
+		return
+	}
+
+	resp.Body.Close()
+
+	// The buffer holds 5 events, with this one the first is lost
+	code, _, _ := call("feed", request{Transaction: []requestItem{{Statement: "INSERT INTO V VALUES (2)"}}}, t)
+	if code != 200 {
+		t.Error("insert failed")
+		return
+	}
+
+	resp, ch = sseConnect("?lastEventId="+strconv.FormatUint(firstEventId-1, 10), t)
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if ce := sseNext(ch, t); ce == nil || ce.Op != "reset" {
+		t.Error("no reset")
+	}
+}
+
+func TestChangeFeedWS(t *testing.T) {
+	conn := wsDial("feed", t)
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+
+	res := wsCall(conn, wsRequest{Id: json.RawMessage(`"sub"`), Action: wsActionSubscribe, Tables: []string{"U"}}, t)
+	if !res.Success {
+		t.Error("could not subscribe:", res.Error)
+		return
+	}
+
+	res = wsCall(conn, wsRequest{Id: json.RawMessage(`"ins"`), request: request{Transaction: []requestItem{{Statement: "INSERT INTO U VALUES (2)"}}}}, t)
+	if !res.Success || string(res.Id) != `"ins"` {
+		t.Error("insert failed:", res.Error)
+		return
+	}
+
+	res = wsRead(conn, t)
+	if string(res.Id) != `"sub"` || res.Event == nil || res.Event.Table != "U" || res.Event.RowId != 2 {
+		t.Error("wrong event")
+		return
+	}
+
+	// When the feed drops the subscriber, the client is told and can
+	// subscribe again
+	stopChangeFeeds()
+	res = wsRead(conn, t)
+	if res.Success || string(res.Id) != `"sub"` || res.Code != 503 {
+		t.Error("the drop was not reported")
+		return
+	}
+
+	res = wsCall(conn, wsRequest{Id: json.RawMessage(`"sub2"`), Action: wsActionSubscribe, Tables: []string{"U"}}, t)
+	if !res.Success {
+		t.Error("could not subscribe again:", res.Error)
+	}
+}
+
+func TestChangeFeedNotEnabled(t *testing.T) {
+	resp, err := http.Get("http://localhost:12321/nofeed/events")
+	if err != nil || resp.StatusCode == 200 {
+		t.Error("the change feed should not be enabled")
+	}
+}
+
+func TestChangeFeedTeardown(t *testing.T) {
+	time.Sleep(time.Second)
+	stopChangeFeeds()
+	Shutdown()
+}
@@ -54,6 +54,9 @@ func parseCLI() config {
 	fs.Var(&memDb, "mem-db", "Repeatable; config for memory-based databases (format: ID[:configFilePath])")
 
 	serveDir := fs.String("serve-dir", "", "A directory to serve with builtin HTTP server")
+	compression := fs.String("compress", "", "Comma-separated list of algorithms to compress the responses, among zstd, br, gzip and deflate")
+	compressionMinSize := fs.Int("compress-min-size", defaultCompressionMinSize, "Minimum size of a response to compress it, in bytes")
+	openAPI := fs.Bool("openapi", false, "Serve an OpenAPI document that describes the databases and their stored statements, at /openapi.json")
 
 	bindHost := fs.String("bind-host", "0.0.0.0", "The host to bind")
 	port := fs.Int("port", 12321, "Port for the web service")
@@ -157,9 +160,20 @@ func parseCLI() config {
 		ret.ServeDir = &sd
 	}
 
+	algos, unknown := parseCompression(*compression)
+	if unknown != "" {
+		mllog.Fatalf("unknown compression algorithm: %s", unknown)
+	}
+	if *compressionMinSize < 0 {
+		mllog.Fatal("the minimum size for compression cannot be negative")
+	}
+
 	// embed the cli parameters in the config
 	ret.Bindhost = *bindHost
 	ret.Port = *port
+	ret.OpenAPI = *openAPI
+	ret.Compression = algos
+	ret.CompressionMinSize = *compressionMinSize
 
 	return ret
 }
@@ -19,6 +19,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"slices"
 	"testing"
 
 	mllog "github.com/proofrock/go-mylittlelogger"
@@ -184,3 +185,19 @@ func TestConfigs(t *testing.T) {
 
 	assert(t, cfg.ServeDir != nil, "a dir to serve should be configured")
 }
+
+func TestCliOpenAPI(t *testing.T) {
+	cfg, err := cliTest("--mem-db", "mem1", "--openapi")
+	assert(t, err == "", "did not succeed ", err)
+	assert(t, cfg.OpenAPI, "the OpenAPI document is not enabled")
+}
+
+func TestCliCompression(t *testing.T) {
+	cfg, err := cliTest("--mem-db", "mem1", "--compress", "gzip, zstd,br", "--compress-min-size", "10")
+	assert(t, err == "", "did not succeed ", err)
+	assert(t, slices.Equal(cfg.Compression, []string{"zstd", "br", "gzip"}), "wrong algorithms ", cfg.Compression)
+	assert(t, cfg.CompressionMinSize == 10, "wrong minimum size")
+
+	_, err = cliTest("--mem-db", "mem1", "--compress", "gzip,lzma")
+	assert(t, err != "", "succeeded, but shouldn't have ", err)
+}
@@ -0,0 +1,165 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gofiber/fiber/v2"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/valyala/fasthttp"
+)
+
+// With --compress, the responses are compressed with one of the specified
+// algorithms, negotiated with the Accept-Encoding header, if they are at
+// least --compress-min-size bytes long. Streamed responses (NDJSON, events)
+// are not compressed. The same algorithms are accepted for the body of the
+// requests, as specified by Content-Encoding; the decompressed body cannot be
+// longer than the maximum size of a request.
+
+const (
+	compressionGzip    = "gzip"
+	compressionDeflate = "deflate"
+	compressionBrotli  = "br"
+	compressionZstd    = "zstd"
+)
+
+// In order of preference, when the client accepts more of them with the same quality
+var compressionAlgorithms = []string{compressionZstd, compressionBrotli, compressionGzip, compressionDeflate}
+
+const defaultCompressionMinSize = 1024
+
+// Parses the list of algorithms from the commandline. Returns the unknown one, if any.
+func parseCompression(list string) ([]string, string) {
+	var ret []string
+	for _, algo := range strings.Split(list, ",") {
+		algo = strings.ToLower(strings.TrimSpace(algo))
+		if algo == "" {
+			continue
+		}
+		if !slices.Contains(compressionAlgorithms, algo) {
+			return nil, algo
+		}
+		if !slices.Contains(ret, algo) {
+			ret = append(ret, algo)
+		}
+	}
+	// Sorted by preference
+	slices.SortFunc(ret, func(a, b string) int {
+		return slices.Index(compressionAlgorithms, a) - slices.Index(compressionAlgorithms, b)
+	})
+	return ret, ""
+}
+
+func compress(algo string, body []byte) []byte {
+	switch algo {
+	case compressionZstd:
+		return fasthttp.AppendZstdBytesLevel(nil, body, fasthttp.CompressZstdDefault)
+	case compressionBrotli:
+		return fasthttp.AppendBrotliBytesLevel(nil, body, fasthttp.CompressBrotliDefaultCompression)
+	case compressionGzip:
+		return fasthttp.AppendGzipBytesLevel(nil, body, fasthttp.CompressDefaultCompression)
+	default:
+		return fasthttp.AppendDeflateBytesLevel(nil, body, fasthttp.CompressDefaultCompression)
+	}
+}
+
+// Decompresses a body, failing if the result is longer than maxSize
+func decompress(algo string, body []byte, maxSize int) ([]byte, error) {
+	var r io.Reader
+	switch algo {
+	case compressionZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	case compressionBrotli:
+		r = brotli.NewReader(bytes.NewReader(body))
+	case compressionGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	default:
+		fr := flate.NewReader(bytes.NewReader(body))
+		defer fr.Close()
+		r = fr
+	}
+
+	ret, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(ret) > maxSize {
+		return nil, newWSError(-1, fiber.StatusRequestEntityTooLarge, "the decompressed body is too large")
+	}
+	return ret, nil
+}
+
+func compressionMiddleware(algos []string, minSize int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if ce := strings.ToLower(strings.TrimSpace(c.Get(fiber.HeaderContentEncoding))); ce != "" && ce != "identity" {
+			if !slices.Contains(algos, ce) {
+				return newWSErrorf(-1, fiber.StatusUnsupportedMediaType, "unsupported content encoding '%s'", ce)
+			}
+			// Not c.Body(), that would decompress some encodings by itself, without limits
+			body, err := decompress(ce, c.Request().Body(), c.App().Config().BodyLimit)
+			if err != nil {
+				if wse, ok := err.(wsError); ok {
+					return wse
+				}
+				return newWSErrorf(-1, fiber.StatusBadRequest, "in decompressing body: %s", err.Error())
+			}
+			c.Request().SetBodyRaw(body)
+			c.Request().Header.Del(fiber.HeaderContentEncoding)
+		}
+
+		if err := c.Next(); err != nil {
+			return err
+		}
+
+		resp := c.Response()
+		status := resp.StatusCode()
+		if resp.IsBodyStream() || status < 200 || status >= 300 || status == fiber.StatusNoContent || status == fiber.StatusPartialContent ||
+			len(resp.Header.Peek(fiber.HeaderContentEncoding)) > 0 || len(resp.Body()) < minSize {
+			return nil
+		}
+
+		c.Vary(fiber.HeaderAcceptEncoding)
+		if c.Get(fiber.HeaderAcceptEncoding) == "" {
+			return nil
+		}
+		algo := c.AcceptsEncodings(algos...)
+		if algo == "" {
+			return nil
+		}
+
+		resp.SetBodyRaw(compress(algo, resp.Body()))
+		c.Set(fiber.HeaderContentEncoding, algo)
+		return nil
+	}
+}
@@ -0,0 +1,151 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const manyRowsQuery = "WITH RECURSIVE C(X) AS (SELECT 1 UNION ALL SELECT X + 1 FROM C WHERE X < 1000) SELECT X, 'some text' AS T FROM C"
+
+func callCompressed(body []byte, contentEncoding, acceptEncoding string, t *testing.T) (int, string, []byte) {
+	req, err := http.NewRequest("POST", "http://localhost:12321/comp", bytes.NewReader(body))
+	if err != nil {
+		t.Error(err)
+		return -1, "", nil
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	// Setting it explicitly disables the transparent decompression of the client
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return -1, "", nil
+	}
+	defer resp.Body.Close()
+
+	bs, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header.Get("Content-Encoding"), bs
+}
+
+func TestCompressionSetup(t *testing.T) {
+	cfg := config{
+		Bindhost:           "0.0.0.0",
+		Port:               12321,
+		Compression:        []string{compressionZstd, compressionGzip},
+		CompressionMinSize: 200,
+		Databases: []db{
+			{
+				Id:             "comp",
+				Path:           ":memory:",
+				InitStatements: []string{"CREATE TABLE T (ID INT)"},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestCompressionResponse(t *testing.T) {
+	req, _ := json.Marshal(request{Transaction: []requestItem{{Query: manyRowsQuery}}})
+
+	code, ce, bs := callCompressed(req, "", "gzip", t)
+	if code != 200 || ce != "gzip" {
+		t.Error("the response was not compressed with gzip:", code, ce)
+		return
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(bs))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var res response
+	if err := json.NewDecoder(gr).Decode(&res); err != nil || len(res.Results[0].ResultSet) != 1000 {
+		t.Error("wrong decompressed response")
+		return
+	}
+
+	code, ce, bs = callCompressed(req, "", "gzip;q=0.5, zstd, br", t)
+	if code != 200 || ce != "zstd" {
+		t.Error("the response was not compressed with zstd:", code, ce)
+		return
+	}
+	zr, _ := zstd.NewReader(bytes.NewReader(bs))
+	defer zr.Close()
+	if err := json.NewDecoder(zr).Decode(&res); err != nil || len(res.Results[0].ResultSet) != 1000 {
+		t.Error("wrong decompressed response")
+		return
+	}
+
+	// Not accepted
+	if _, ce, _ = callCompressed(req, "", "br", t); ce != "" {
+		t.Error("the response was compressed with an algorithm that's not enabled")
+		return
+	}
+
+	// Too small
+	req, _ = json.Marshal(request{Transaction: []requestItem{{Query: "SELECT 1"}}})
+	if _, ce, _ = callCompressed(req, "", "gzip", t); ce != "" {
+		t.Error("a small response was compressed")
+	}
+}
+
+func TestCompressionRequest(t *testing.T) {
+	var batch []json.RawMessage
+	for i := 0; i < 1000; i++ {
+		batch = append(batch, mkRaw([]int{i}))
+	}
+	req, _ := json.Marshal(request{Transaction: []requestItem{{Statement: "INSERT INTO T VALUES (?)", ValuesBatch: batch}}})
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(req)
+	gw.Close()
+
+	code, _, bs := callCompressed(buf.Bytes(), "gzip", "", t)
+	if code != 200 {
+		t.Error("the compressed request failed:", string(bs))
+		return
+	}
+
+	if code, _, _ = callCompressed(buf.Bytes(), "zstd", "", t); code != 400 {
+		t.Error("a request with the wrong encoding succeeded:", code)
+		return
+	}
+
+	if code, _, _ = callCompressed(req, "compress", "", t); code != 415 {
+		t.Error("a request with an unsupported encoding succeeded:", code)
+	}
+}
+
+func TestCompressionTeardown(t *testing.T) {
+	time.Sleep(time.Second)
+	Shutdown()
+}
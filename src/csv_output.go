@@ -0,0 +1,117 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The CSV format (RFC 4180) can represent only one result set, so the
+// transaction must be made of a single query.
+func ckCSVRequest(body *request) error {
+	if len(body.Transaction) != 1 || body.Transaction[0].Query == "" {
+		return errors.New("the csv format requires a transaction with a single query")
+	}
+	if body.Transaction[0].NoFail {
+		return errors.New("the csv format doesn't allow noFail")
+	}
+	if body.BlobFormat != nil && strings.EqualFold(*body.BlobFormat, blobFormatTagged) {
+		return errors.New("the csv format doesn't allow tagged blobs")
+	}
+	if body.CSVOptions != nil && body.CSVOptions.Delimiter != "" {
+		delim := body.CSVOptions.Delimiter
+		if utf8.RuneCountInString(delim) != 1 || delim == "\"" || delim == "\r" || delim == "\n" {
+			return errors.New("the csv delimiter must be a single character, not a quote or a newline")
+		}
+	}
+	return nil
+}
+
+func csvContentType(opts *csvOptions) string {
+	if opts != nil && opts.NoHeader {
+		return "text/csv; charset=utf-8; header=absent"
+	}
+	return "text/csv; charset=utf-8; header=present"
+}
+
+// Converts a value, as scanned from the database, into a CSV field. BLOBs
+// are encoded as base64, as they would be in JSON, unless they were already
+// converted to hex.
+func value2csv(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case hexBlob:
+		return string(v)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Renders a list-style result set as CSV, with a header row unless told
+// otherwise. Uses CRLF as line terminator, as per the RFC.
+func results2csv(item responseItem, opts *csvOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.UseCRLF = true
+	if opts != nil && opts.Delimiter != "" {
+		w.Comma, _ = utf8.DecodeRuneInString(opts.Delimiter)
+	}
+
+	if opts == nil || !opts.NoHeader {
+		if err := w.Write(item.ResultHeaders); err != nil {
+			return nil, err
+		}
+	}
+
+	record := make([]string, len(item.ResultHeaders))
+	for _, row := range item.ResultSetList {
+		for i := range row {
+			record[i] = value2csv(row[i])
+		}
+		if err := w.Write(record); err != nil {
+			return nil, err
+		}
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,464 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/iancoleman/orderedmap"
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+const defaultCursorIdleSecs = 60
+const defaultMaxCursors = 8
+
+// A cursor serves the result set of a query in pages. The first page is
+// returned by the request that opens it, and the following ones are fetched
+// with subsequent calls, using the ID of the cursor, until the rows are over
+// (when the cursor is closed automatically) or the client closes it.
+//
+// The rows are kept open in a read transaction on a dedicated connection,
+// that with WAL doesn't block the writers on the main one. To play nice with
+// them, each page is fetched holding the mutex of the database, that is
+// released between pages; so the other requests are served in the meantime.
+//
+// The maxRows of the database applies to all the rows that the cursor serves,
+// not only to a page.
+type cursor struct {
+	Id       string
+	Db       *db
+	Conn     *sql.Conn
+	Tx       *sql.Tx
+	Rows     *sql.Rows
+	Ctx      context.Context
+	Cancel   context.CancelCauseFunc
+	Headers  []string
+	Opts     resultSetOpts
+	PageSize int
+	Served   int        // rows returned so far, in all the pages
+	HasRow   bool       // Next() was called and a row is waiting to be scanned
+	Mutex    sync.Mutex // serializes the calls on this cursor
+	Timer    *time.Timer
+	Deadline time.Time
+	Closed   bool
+}
+
+var cursors = make(map[string]*cursor)
+var cursorsMutex sync.Mutex
+
+func (cur *cursor) idleTimeout() time.Duration {
+	return time.Duration(cur.Db.CursorIdleSecs) * time.Second
+}
+
+// Postpones the idle timeout, to be called when the cursor is used
+func (cur *cursor) touch() {
+	cur.Deadline = time.Now().Add(cur.idleTimeout())
+	cur.Timer.Reset(cur.idleTimeout())
+}
+
+// Called by the timer; see interactiveTx.expire()
+func (cur *cursor) expire() {
+	cur.Mutex.Lock()
+	defer cur.Mutex.Unlock()
+
+	if cur.Closed {
+		return
+	}
+
+	if remaining := time.Until(cur.Deadline); remaining > 0 {
+		cur.Timer.Reset(remaining)
+		return
+	}
+
+	mllog.Warnf("cursor on '%s' expired, closing", cur.Db.Id)
+	cur.close()
+}
+
+// Closes the rows and releases the connection. The caller must hold the mutex
+// of the cursor, if it's registered.
+func (cur *cursor) close() {
+	cur.Closed = true
+	if cur.Timer != nil {
+		cur.Timer.Stop()
+	}
+
+	cursorsMutex.Lock()
+	delete(cursors, cur.Id)
+	cursorsMutex.Unlock()
+
+	cur.Rows.Close()
+	cur.Tx.Rollback()
+	cur.release()
+}
+
+// Gives back the connection to the pool, that must be writable again, and
+// frees the context.
+func (cur *cursor) release() {
+	if !cur.Db.ReadOnly {
+		cur.Conn.ExecContext(context.Background(), "PRAGMA query_only = 0")
+	}
+	cur.Conn.Close()
+	cur.Cancel(nil)
+}
+
+// Interrupts the cursor if the timeout configured for the database expires
+// before the returned function is called. The timeout applies to the single
+// call, not to the whole life of the cursor.
+func (cur *cursor) armTimeout() func() bool {
+	if cur.Db.TimeoutMillis <= 0 {
+		return func() bool { return true }
+	}
+	timer := time.AfterFunc(time.Duration(cur.Db.TimeoutMillis)*time.Millisecond, func() {
+		cur.Cancel(context.DeadlineExceeded)
+	})
+	return timer.Stop
+}
+
+// Converts an error in reading the rows, telling if it's due to the timeout
+// or to the limit of rows
+func (cur *cursor) fetchError(reqIdx int, err error) error {
+	if context.Cause(cur.Ctx) == context.DeadlineExceeded {
+		return newWSError(reqIdx, fiber.StatusGatewayTimeout, errTimeout)
+	}
+	if errors.Is(err, errTooManyRows) {
+		return newWSError(reqIdx, fiber.StatusBadRequest, err.Error())
+	}
+	return newWSError(reqIdx, fiber.StatusInternalServerError, err.Error())
+}
+
+// Reads the next page of rows. If the rows are over, or the maximum number of
+// rows was served, the cursor is closed, otherwise its ID is set in the
+// response. The caller must hold the mutex of the database.
+func (cur *cursor) fetchPage() (*responseItem, error) {
+	resultSet := make([]orderedmap.OrderedMap, 0)
+	resultSetList := make([][]interface{}, 0)
+
+	var resultTypes []resultType
+	if cur.Opts.withTypes {
+		var err error
+		if resultTypes, err = newResultTypes(cur.Rows); err != nil {
+			return nil, err
+		}
+	}
+
+	pageSize := cur.PageSize
+	if cur.Opts.maxRows > 0 {
+		pageSize = min(pageSize, cur.Opts.maxRows-cur.Served)
+	}
+
+	for n := 0; n < pageSize && cur.HasRow; n++ {
+		if cur.Opts.withTypes {
+			if err := addStorageClasses(cur.Rows, resultTypes); err != nil {
+				return nil, err
+			}
+		}
+
+		values, err := scanRow(cur.Rows, len(cur.Headers), cur.Opts)
+		if err != nil {
+			return nil, err
+		}
+
+		if cur.Opts.isList {
+			resultSetList = append(resultSetList, values)
+		} else {
+			resultSet = append(resultSet, row2map(cur.Headers, values))
+		}
+
+		// Looks ahead, to know if there's another page
+		cur.HasRow = cur.Rows.Next()
+		cur.Served++
+	}
+
+	truncated := false
+	if cur.HasRow && cur.Opts.maxRows > 0 && cur.Served >= cur.Opts.maxRows {
+		if cur.Opts.failOnLimit {
+			return nil, errTooManyRows
+		}
+		truncated = true
+		cur.HasRow = false
+	}
+
+	if !cur.HasRow {
+		if err := cur.Rows.Err(); err != nil {
+			return nil, err
+		}
+		cur.close()
+	}
+
+	ret := responseItem{Success: true, ResultHeaders: cur.Headers, ResultTypes: resultTypes, Truncated: truncated}
+	if cur.Opts.isList {
+		ret.ResultSetList = resultSetList
+	} else {
+		ret.ResultSet = resultSet
+	}
+	if !cur.Closed {
+		ret.Cursor = cur.Id
+	}
+	return &ret, nil
+}
+
+// Checks that a request is suitable to open a cursor: it must have only one
+// query, that is not noFail, and the result format must be the default one
+// or "list".
+func ckCursorRequest(db *db, body *request) error {
+	if len(body.Transaction) != 1 || body.Transaction[0].Query == "" {
+		return newWSError(-1, fiber.StatusBadRequest, "to open a cursor, the request must have only one query")
+	}
+
+	if body.Transaction[0].NoFail {
+		return newWSError(0, fiber.StatusBadRequest, "a query with a cursor cannot be noFail")
+	}
+
+	if body.Transaction[0].PageSize < 0 {
+		return newWSError(0, fiber.StatusBadRequest, "pageSize cannot be negative")
+	}
+
+	if db.MaxRows > 0 && body.Transaction[0].PageSize > db.MaxRows {
+		return newWSErrorf(0, fiber.StatusBadRequest, "pageSize cannot be greater than maxRows (%d)", db.MaxRows)
+	}
+
+	if body.Transaction[0].Limit != 0 {
+		return newWSError(0, fiber.StatusBadRequest, "a query with a cursor cannot have a limit")
+	}
+
+	if body.ResultFormat != nil && !strings.EqualFold(*body.ResultFormat, resultFormatList) {
+		return newWSErrorf(-1, fiber.StatusBadRequest, "result format '%s' is not supported with cursors", *body.ResultFormat)
+	}
+
+	// An in-memory database is not shared between connections; without WAL,
+	// the read transaction would prevent the writes.
+	if strings.Contains(db.Path, ":memory:") || db.DisableWALMode {
+		return newWSError(-1, fiber.StatusBadRequest, "cursors are only supported for file databases in WAL mode")
+	}
+
+	return nil
+}
+
+// Opens a cursor for the (only) query of the request, and returns the first
+// page. The caller must hold the mutex of the database.
+func openCursor(db *db, body *request) (*responseItem, error) {
+	txItem := body.Transaction[0]
+
+	cursorsMutex.Lock()
+	count := 0
+	for _, cur := range cursors {
+		if cur.Db.Id == db.Id {
+			count++
+		}
+	}
+	cursorsMutex.Unlock()
+	if count >= db.MaxCursors {
+		return nil, newWSErrorf(-1, fiber.StatusTooManyRequests, "too many open cursors (max %d)", db.MaxCursors)
+	}
+
+	sqll, err := resolveSQL(db, txItem.Query)
+	if err != nil {
+		return nil, newWSError(0, fiber.StatusBadRequest, err.Error())
+	}
+
+	params, err := raw2params(txItem.Values)
+	if err != nil {
+		return nil, newWSError(0, fiber.StatusInternalServerError, err.Error())
+	}
+
+	id, err := genTxId()
+	if err != nil {
+		return nil, newWSError(-1, fiber.StatusInternalServerError, err.Error())
+	}
+
+	cur := &cursor{
+		Id:       id,
+		Db:       db,
+		Opts:     newResultSetOpts(body),
+		PageSize: txItem.PageSize,
+	}
+	cur.Opts.maxRows, cur.Opts.failOnLimit = rowLimit(db, txItem, false)
+	cur.Ctx, cur.Cancel = context.WithCancelCause(context.Background())
+
+	if cur.Conn, err = db.Db.Conn(cur.Ctx); err != nil {
+		cur.Cancel(nil)
+		return nil, newWSError(-1, fiber.StatusInternalServerError, err.Error())
+	}
+
+	// As for the GET calls, the driver doesn't enforce the ReadOnly of the
+	// transaction, so the connection is made query only; a write would
+	// otherwise hold the write lock until the cursor is closed, and then
+	// be rolled back.
+	if !db.ReadOnly {
+		if _, err = cur.Conn.ExecContext(cur.Ctx, "PRAGMA query_only = 1"); err != nil {
+			cur.release()
+			return nil, newWSError(-1, fiber.StatusInternalServerError, err.Error())
+		}
+	}
+
+	if cur.Tx, err = cur.Conn.BeginTx(cur.Ctx, &sql.TxOptions{ReadOnly: true}); err != nil {
+		cur.release()
+		return nil, newWSError(-1, fiber.StatusInternalServerError, err.Error())
+	}
+
+	stopTimeout := cur.armTimeout()
+	defer stopTimeout()
+
+	if params.UnmarshalledDict != nil {
+		cur.Rows, err = cur.Tx.QueryContext(cur.Ctx, sqll, vals2nameds(params.UnmarshalledDict)...)
+	} else {
+		cur.Rows, err = cur.Tx.QueryContext(cur.Ctx, sqll, params.UnmarshalledArray...)
+	}
+	if err != nil {
+		ret := cur.fetchError(0, err)
+		cur.Tx.Rollback()
+		cur.release()
+		return nil, ret
+	}
+
+	cur.Headers, _ = cur.Rows.Columns() // I can ignore the error, rows aren't closed
+	cur.HasRow = cur.Rows.Next()
+
+	ret, err := cur.fetchPage()
+	if err != nil {
+		ret := cur.fetchError(0, err)
+		if !cur.Closed {
+			cur.close()
+		}
+		return nil, ret
+	}
+
+	if !cur.Closed {
+		// The timer reads the fields holding the mutex of the cursor
+		cur.Mutex.Lock()
+		cur.Deadline = time.Now().Add(cur.idleTimeout())
+		cur.Timer = time.AfterFunc(cur.idleTimeout(), cur.expire)
+
+		cursorsMutex.Lock()
+		cursors[id] = cur
+		cursorsMutex.Unlock()
+		cur.Mutex.Unlock()
+	}
+
+	return ret, nil
+}
+
+// Retrieves an open cursor, and locks it. The caller must unlock it.
+func lockCursor(db *db, cursorId string) (*cursor, error) {
+	cursorsMutex.Lock()
+	cur, found := cursors[cursorId]
+	cursorsMutex.Unlock()
+
+	if found {
+		cur.Mutex.Lock()
+		if !cur.Closed && cur.Db.Id == db.Id {
+			return cur, nil
+		}
+		cur.Mutex.Unlock()
+	}
+
+	return nil, newWSErrorf(-1, fiber.StatusNotFound, "cursor '%s' not found (expired or exhausted?)", cursorId)
+}
+
+// Handler for the call that fetches the next page of a cursor. The body can be
+// empty, or contain only the credentials (for INLINE auth). The response is the
+// same as for a "normal" request with one query.
+func cursorPageHandler(databaseId string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		var body request
+		if len(c.Body()) > 0 {
+			if err := parseBody(c, &body); err != nil {
+				return newWSErrorf(-1, fiber.StatusBadRequest, "in parsing body: %s", err.Error())
+			}
+		}
+
+		db, err := lookupDb(databaseId)
+		if err != nil {
+			return err
+		}
+
+		cur, err := lockCursor(&db, c.Params("cursorId"))
+		if err != nil {
+			return err
+		}
+		defer cur.Mutex.Unlock()
+
+		// Execute non-concurrently
+		if err := lockDb(&db); err != nil {
+			return err
+		}
+		defer db.Mutex.Unlock()
+
+		if err := ckInlineAuth(&db, &body); err != nil {
+			return err
+		}
+
+		cur.touch()
+
+		stopTimeout := cur.armTimeout()
+		defer stopTimeout()
+
+		item, err := cur.fetchPage()
+		if err != nil {
+			ret := cur.fetchError(0, err)
+			if !cur.Closed {
+				cur.close()
+			}
+			return ret
+		}
+
+		return sendResponse(c, 200, response{Results: []responseItem{*item}})
+	}
+}
+
+// Handler for the call that closes a cursor before the rows are over. The body
+// can be empty, or contain only the credentials (for INLINE auth).
+func cursorCloseHandler(databaseId string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		var body request
+		if len(c.Body()) > 0 {
+			if err := parseBody(c, &body); err != nil {
+				return newWSErrorf(-1, fiber.StatusBadRequest, "in parsing body: %s", err.Error())
+			}
+		}
+
+		db, err := lookupDb(databaseId)
+		if err != nil {
+			return err
+		}
+
+		cur, err := lockCursor(&db, c.Params("cursorId"))
+		if err != nil {
+			return err
+		}
+		defer cur.Mutex.Unlock()
+
+		if err := lockDb(&db); err != nil {
+			return err
+		}
+		defer db.Mutex.Unlock()
+
+		if err := ckInlineAuth(&db, &body); err != nil {
+			return err
+		}
+
+		cur.close()
+
+		return sendResponse(c, 200, cursorResponse{Cursor: cur.Id, Success: true})
+	}
+}
@@ -0,0 +1,250 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func openCur(pageSize int, t *testing.T) (int, responseItem) {
+	code, _, res := call("cur", request{Transaction: []requestItem{{Query: "SELECT ID FROM T ORDER BY ID", PageSize: pageSize}}}, t)
+	if code != 200 {
+		return code, responseItem{}
+	}
+	return code, res.Results[0]
+}
+
+func TestCursorSetup(t *testing.T) {
+	os.Remove("../test/cur.db")
+
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:             "cur",
+				Path:           "../test/cur.db",
+				CursorIdleSecs: 1,
+				MaxCursors:     2,
+				InitStatements: []string{
+					"CREATE TABLE T (ID INT PRIMARY KEY)",
+					"INSERT INTO T VALUES (1), (2), (3), (4), (5)",
+				},
+			},
+			{
+				Id:      "curmax",
+				Path:    "../test/cur.db",
+				MaxRows: 3,
+			},
+			{
+				Id:            "curfail",
+				Path:          "../test/cur.db",
+				MaxRows:       3,
+				FailOnMaxRows: true,
+			},
+			{
+				Id:   "curmem",
+				Path: ":memory:",
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestCursorPaging(t *testing.T) {
+	code, item := openCur(2, t)
+	if code != 200 || len(item.ResultSet) != 2 || item.Cursor == "" {
+		t.Error("wrong first page")
+		return
+	}
+
+	// A write is not blocked by the open cursor, that doesn't see it
+	code, _, _ = call("cur", request{Transaction: []requestItem{{Statement: "INSERT INTO T VALUES (6)"}}}, t)
+	if code != 200 {
+		t.Error("insert failed while a cursor is open")
+		return
+	}
+
+	var ids []float64
+	cursorId := item.Cursor
+	for {
+		for _, row := range item.ResultSet {
+			ids = append(ids, getDefault[float64](row, "ID"))
+		}
+		if item.Cursor == "" {
+			break
+		}
+		code, _, res := call("cur/cursor/"+item.Cursor, request{}, t)
+		if code != 200 {
+			t.Error("failed to fetch page")
+			return
+		}
+		item = res.Results[0]
+	}
+
+	if len(ids) != 5 || ids[0] != 1 || ids[4] != 5 {
+		t.Error("wrong rows:", ids)
+		return
+	}
+
+	// The last page closes the cursor
+	code, _, _ = call("cur/cursor/"+cursorId, request{}, t)
+	if code != 404 {
+		t.Error("the cursor is still there")
+	}
+
+	code, _, _ = call("cur", request{Transaction: []requestItem{{Statement: "DELETE FROM T WHERE ID = 6"}}}, t)
+	if code != 200 {
+		t.Error("delete failed")
+	}
+}
+
+func TestCursorMaxRows(t *testing.T) {
+	req := request{Transaction: []requestItem{{Query: "SELECT ID FROM T ORDER BY ID", PageSize: 2}}}
+
+	// The limit applies to all the pages
+	code, _, res := call("curmax", req, t)
+	if code != 200 || len(res.Results[0].ResultSet) != 2 || res.Results[0].Truncated {
+		t.Error("wrong first page")
+		return
+	}
+	code, _, res = call("curmax/cursor/"+res.Results[0].Cursor, request{}, t)
+	if code != 200 || len(res.Results[0].ResultSet) != 1 || !res.Results[0].Truncated || res.Results[0].Cursor != "" {
+		t.Error("the rows were not truncated")
+		return
+	}
+
+	code, _, res = call("curfail", req, t)
+	if code != 200 || len(res.Results[0].ResultSet) != 2 {
+		t.Error("wrong first page")
+		return
+	}
+	cursorId := res.Results[0].Cursor
+	if code, _, _ = call("curfail/cursor/"+cursorId, request{}, t); code != 400 {
+		t.Error("too many rows were served", code)
+		return
+	}
+	if code, _, _ = call("curfail/cursor/"+cursorId, request{}, t); code != 404 {
+		t.Error("the cursor was not closed", code)
+	}
+}
+
+func TestCursorSinglePage(t *testing.T) {
+	code, item := openCur(10, t)
+	if code != 200 || len(item.ResultSet) != 5 || item.Cursor != "" {
+		t.Error("the rows should fit in a page, without a cursor")
+	}
+}
+
+func TestCursorClose(t *testing.T) {
+	code, item := openCur(2, t)
+	if code != 200 || item.Cursor == "" {
+		t.Error("failed to open cursor")
+		return
+	}
+
+	code, _ = callRawBA("cur/cursor/"+item.Cursor+"/close", request{}, "", "", t)
+	if code != 200 {
+		t.Error("failed to close cursor")
+		return
+	}
+
+	code, _, _ = call("cur/cursor/"+item.Cursor, request{}, t)
+	if code != 404 {
+		t.Error("the cursor is still there")
+	}
+}
+
+func TestCursorIdleTimeout(t *testing.T) {
+	code, item := openCur(2, t)
+	if code != 200 || item.Cursor == "" {
+		t.Error("failed to open cursor")
+		return
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	code, _, _ = call("cur/cursor/"+item.Cursor, request{}, t)
+	if code != 404 {
+		t.Error("the cursor didn't expire")
+	}
+}
+
+func TestCursorTooMany(t *testing.T) {
+	var ids []string
+	for i := 0; i < 2; i++ {
+		code, item := openCur(1, t)
+		if code != 200 || item.Cursor == "" {
+			t.Error("failed to open cursor")
+			return
+		}
+		ids = append(ids, item.Cursor)
+	}
+
+	code, _ := openCur(1, t)
+	if code != 429 {
+		t.Error("opened more cursors than allowed")
+	}
+
+	for _, id := range ids {
+		callRawBA("cur/cursor/"+id+"/close", request{}, "", "", t)
+	}
+}
+
+func TestCursorKO(t *testing.T) {
+	code, _, _ := call("curmem", request{Transaction: []requestItem{{Query: "SELECT 1", PageSize: 1}}}, t)
+	if code != 400 {
+		t.Error("cursors should not be allowed on in-memory databases")
+	}
+
+	code, _, _ = call("cur", request{Transaction: []requestItem{{Query: "SELECT 1", PageSize: 1}, {Query: "SELECT 1"}}}, t)
+	if code != 400 {
+		t.Error("cursors should be allowed only on single queries")
+	}
+
+	code, _, _ = call("cur", request{Transaction: []requestItem{{Query: "SELECT 1"}, {Query: "SELECT 1", PageSize: 1}}}, t)
+	if code != 400 {
+		t.Error("pageSize should be allowed only on single queries")
+	}
+}
+
+func TestCursorReadOnly(t *testing.T) {
+	code, _, _ := call("cur", request{Transaction: []requestItem{{Query: "DELETE FROM T RETURNING *", PageSize: 2}}}, t)
+	if code == 200 {
+		t.Error("a cursor was opened on a write")
+		return
+	}
+
+	// The database can be written, and nothing was deleted
+	code, _, res := call("cur", request{Transaction: []requestItem{
+		{Statement: "UPDATE T SET ID = ID"},
+		{Query: "SELECT COUNT(1) AS C FROM T"},
+	}}, t)
+	if code != 200 || getDefault[float64](res.Results[1].ResultSet[0], "C") != 5 {
+		t.Error("the write was not refused", code)
+	}
+}
+
+func TestCursorTeardown(t *testing.T) {
+	time.Sleep(time.Second)
+	Shutdown()
+	os.Remove("../test/cur.db")
+}
@@ -0,0 +1,115 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDryRunSetup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:            "dry",
+				Path:          ":memory:",
+				InteractiveTx: true,
+				InitStatements: []string{
+					"CREATE TABLE T (ID INT PRIMARY KEY, VAL TEXT)",
+					"CREATE INDEX T_VAL ON T (VAL)",
+					"INSERT INTO T VALUES (1, 'ONE'), (2, 'TWO')",
+				},
+				StoredStatement: []storedStatement{{Id: "byVal", Sql: "SELECT * FROM T WHERE VAL = :val"}},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestDryRun(t *testing.T) {
+	req := request{
+		DryRun: true,
+		Transaction: []requestItem{
+			{Statement: "DELETE FROM T WHERE ID = 1"},
+			{Statement: "INSERT INTO T VALUES (3, 'THREE')"},
+			{Query: "SELECT COUNT(1) AS C FROM T"},
+		},
+	}
+	code, _, res := call("dry", req, t)
+	if code != 200 || !res.DryRun || *res.Results[0].RowsUpdated != 1 || getDefault[float64](res.Results[2].ResultSet[0], "C") != 2 {
+		t.Error("wrong result")
+		return
+	}
+
+	code, _, res = call("dry", request{Transaction: []requestItem{{Query: "SELECT COUNT(1) AS C FROM T WHERE ID IN (1, 2)"}}}, t)
+	if code != 200 || res.DryRun || getDefault[float64](res.Results[0].ResultSet[0], "C") != 2 {
+		t.Error("the transaction was not rolled back")
+	}
+}
+
+func TestDryRunInteractiveTx(t *testing.T) {
+	txId := beginTx("dry", t)
+
+	code, _, _ := call("dry/tx/"+txId, request{DryRun: true, Transaction: []requestItem{{Query: "SELECT 1"}}}, t)
+	if code != 400 {
+		t.Error("dryRun was accepted in an interactive transaction")
+	}
+
+	if code, _ = callRawBA("dry/tx/"+txId+"/rollback", request{}, "", "", t); code != 200 {
+		t.Error("the transaction was closed")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			{Query: "#byVal", Values: mkRaw(map[string]any{"val": "ONE"}), Explain: true},
+			{Statement: "DELETE FROM T", Explain: true},
+			{Query: "SELECT COUNT(1) AS C FROM T"},
+		},
+	}
+	code, _, res := call("dry", req, t)
+	if code != 200 || len(res.Results[0].QueryPlan) == 0 || res.Results[0].ResultSet != nil {
+		t.Error("wrong result")
+		return
+	}
+
+	if !strings.Contains(res.Results[0].QueryPlan[0].Detail, "T_VAL") {
+		t.Error("the plan does not use the index:", res.Results[0].QueryPlan[0].Detail)
+		return
+	}
+
+	if getDefault[float64](res.Results[2].ResultSet[0], "C") != 2 {
+		t.Error("an explained statement was executed")
+		return
+	}
+
+	code, _, _ = call("dry", request{Transaction: []requestItem{{Precondition: "SELECT 1", Explain: true}}}, t)
+	if code != 400 {
+		t.Error("a precondition was explained")
+	}
+}
+
+func TestDryRunTeardown(t *testing.T) {
+	time.Sleep(time.Second)
+	Shutdown()
+}
@@ -0,0 +1,361 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/iancoleman/orderedmap"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/wI2L/jettison"
+)
+
+// Besides JSON, requests and responses can be encoded in MessagePack or CBOR.
+// The encoding of the request is given by its Content-Type; the one of the
+// response by the Accept header, defaulting to the one of the request.
+//
+// A binary request is converted to JSON before being parsed, so it follows
+// the same rules; BLOBs and integers in the values are converted to tagged
+// values ({"$blob": ...} and {"$int": ...}), so they are passed to the
+// database as they are. A binary response has native BLOBs and integers; the
+// fields and their order are the same as in the JSON one.
+
+const (
+	encodingJSON    = "json"
+	encodingMsgpack = "msgpack"
+	encodingCBOR    = "cbor"
+)
+
+const (
+	mimeMsgpack = "application/msgpack"
+	mimeCBOR    = "application/cbor"
+)
+
+var msgpackMimes = []string{mimeMsgpack, "application/x-msgpack", "application/vnd.msgpack"}
+
+func mime2encoding(mime string) string {
+	mime, _, _ = strings.Cut(mime, ";")
+	mime = strings.ToLower(strings.TrimSpace(mime))
+	switch {
+	case slices.Contains(msgpackMimes, mime):
+		return encodingMsgpack
+	case mime == mimeCBOR:
+		return encodingCBOR
+	default:
+		return encodingJSON
+	}
+}
+
+func requestEncoding(c *fiber.Ctx) string {
+	return mime2encoding(c.Get(fiber.HeaderContentType))
+}
+
+func responseEncoding(c *fiber.Ctx) string {
+	accept := strings.TrimSpace(c.Get(fiber.HeaderAccept))
+	if accept == "" || accept == "*/*" {
+		return requestEncoding(c)
+	}
+	// Accepts() considers the qualities; if nothing matches, JSON is used anyway
+	return mime2encoding(c.Accepts(fiber.MIMEApplicationJSON, mimeMsgpack, "application/x-msgpack", "application/vnd.msgpack", mimeCBOR))
+}
+
+// Parses the body of the request, in the encoding given by its Content-Type
+func parseBody(c *fiber.Ctx, out any) error {
+	var decoded any
+	switch requestEncoding(c) {
+	case encodingMsgpack:
+		if err := msgpack.Unmarshal(c.Body(), &decoded); err != nil {
+			return err
+		}
+	case encodingCBOR:
+		dm, _ := cbor.DecOptions{DefaultMapType: reflect.TypeFor[map[string]any]()}.DecMode()
+		if err := dm.Unmarshal(c.Body(), &decoded); err != nil {
+			return err
+		}
+	default:
+		return c.BodyParser(out)
+	}
+
+	bs, err := json.Marshal(binary2JSON(decoded, false))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, out)
+}
+
+// Converts a value decoded from MessagePack or CBOR into one that can be
+// marshalled to JSON. Under "values" and "valuesBatch", BLOBs and integers
+// become tagged values.
+func binary2JSON(val any, inValues bool) any {
+	switch v := val.(type) {
+	case map[string]any:
+		ret := make(map[string]any, len(v))
+		for key, item := range v {
+			ret[key] = binary2JSON(item, inValues || key == "values" || key == "valuesBatch")
+		}
+		return ret
+	case []any:
+		ret := make([]any, len(v))
+		for i := range v {
+			ret[i] = binary2JSON(v[i], inValues)
+		}
+		return ret
+	case []byte:
+		if inValues {
+			return map[string]any{blobTag: base64.StdEncoding.EncodeToString(v)}
+		}
+		return string(v)
+	}
+
+	// The decoders produce integers of various sizes
+	if inValues {
+		switch rv := reflect.ValueOf(val); rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return map[string]any{intTag: strconv.FormatInt(rv.Int(), 10)}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return map[string]any{intTag: strconv.FormatUint(rv.Uint(), 10)}
+		}
+	}
+	return val
+}
+
+// A response, encoded and ready to be sent
+type renderedResponse struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// Encodes the response, in the encoding that the client accepts
+func encodeResponse(c *fiber.Ctx, status int, val any) (*renderedResponse, error) {
+	ret := renderedResponse{Status: status}
+	var err error
+	switch responseEncoding(c) {
+	case encodingMsgpack:
+		ret.ContentType = mimeMsgpack
+		ret.Body, err = msgpack.Marshal(toBinaryTree(reflect.ValueOf(val)))
+	case encodingCBOR:
+		ret.ContentType = mimeCBOR
+		ret.Body, err = cbor.Marshal(toBinaryTree(reflect.ValueOf(val)))
+	default:
+		ret.ContentType = fiber.MIMEApplicationJSON
+		ret.Body, err = jettison.Marshal(val)
+	}
+	if err != nil {
+		return nil, newWSError(-1, fiber.StatusInternalServerError, err.Error())
+	}
+	return &ret, nil
+}
+
+func sendRendered(c *fiber.Ctx, resp *renderedResponse) error {
+	c.Set(fiber.HeaderContentType, resp.ContentType)
+	return c.Status(resp.Status).Send(resp.Body)
+}
+
+// Sends the response, in the encoding that the client accepts
+func sendResponse(c *fiber.Ctx, status int, val any) error {
+	resp, err := encodeResponse(c, status, val)
+	if err != nil {
+		return err
+	}
+	return sendRendered(c, resp)
+}
+
+// A map that keeps the order of its keys, when encoded in MessagePack or CBOR
+type binaryMap struct {
+	keys   []string
+	values []any
+}
+
+func (m *binaryMap) set(key string, val any) {
+	m.keys = append(m.keys, key)
+	m.values = append(m.values, val)
+}
+
+func (m binaryMap) EncodeMsgpack(enc *msgpack.Encoder) error {
+	if err := enc.EncodeMapLen(len(m.keys)); err != nil {
+		return err
+	}
+	for i := range m.keys {
+		if err := enc.EncodeString(m.keys[i]); err != nil {
+			return err
+		}
+		if err := enc.Encode(m.values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m binaryMap) MarshalCBOR() ([]byte, error) {
+	// Header of a map (major type 5) with its length, see RFC 8949
+	n := uint64(len(m.keys))
+	var ret []byte
+	switch {
+	case n < 24:
+		ret = []byte{0xa0 | byte(n)}
+	case n <= 0xff:
+		ret = []byte{0xb8, byte(n)}
+	case n <= 0xffff:
+		ret = []byte{0xb9, byte(n >> 8), byte(n)}
+	default:
+		ret = []byte{0xba, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	for i := range m.keys {
+		for _, item := range []any{m.keys[i], m.values[i]} {
+			bs, err := cbor.Marshal(item)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, bs...)
+		}
+	}
+	return ret, nil
+}
+
+// Converts a value to a tree of maps, slices and scalars, following the
+// "json" tags of the structs (including omitempty and jettison's omitnil),
+// so that it can be encoded in MessagePack or CBOR like it is in JSON.
+func toBinaryTree(v reflect.Value) any {
+	if !v.IsValid() {
+		return nil
+	}
+
+	switch val := v.Interface().(type) {
+	case orderedmap.OrderedMap:
+		ret := binaryMap{}
+		for _, key := range val.Keys() {
+			item, _ := val.Get(key)
+			ret.set(key, toBinaryTree(reflect.ValueOf(item)))
+		}
+		return ret
+	case json.RawMessage:
+		var ret any
+		if len(val) == 0 || json.Unmarshal(val, &ret) != nil {
+			return nil
+		}
+		return ret
+	case []byte:
+		return val
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return toBinaryTree(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		ret := make([]any, v.Len())
+		for i := range ret {
+			ret[i] = toBinaryTree(v.Index(i))
+		}
+		return ret
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		ret := binaryMap{}
+		keys := v.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int { return strings.Compare(a.String(), b.String()) })
+		for _, key := range keys {
+			ret.set(key.String(), toBinaryTree(v.MapIndex(key)))
+		}
+		return ret
+	case reflect.Struct:
+		ret := binaryMap{}
+		addStructFields(v, &ret)
+		return ret
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint()
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return v.Bool()
+	}
+	return v.Interface()
+}
+
+// Adds the fields of a struct to a map. The fields of an embedded struct are
+// added in its place, unless they are shadowed by a field of the outer one.
+func addStructFields(v reflect.Value, ret *binaryMap) {
+	t := v.Type()
+	var outer []string
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		outer = append(outer, name)
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			inner := binaryMap{}
+			addStructFields(v.Field(i), &inner)
+			for j := range inner.keys {
+				if !slices.Contains(outer, inner.keys[j]) {
+					ret.set(inner.keys[j], inner.values[j])
+				}
+			}
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		fv := v.Field(i)
+		if strings.Contains(opts, "omitempty") && isEmptyValue(fv) ||
+			strings.Contains(opts, "omitnil") && (fv.Kind() == reflect.Slice || fv.Kind() == reflect.Pointer) && fv.IsNil() {
+			continue
+		}
+		ret.set(name, toBinaryTree(fv))
+	}
+}
+
+// As in encoding/json, for omitempty
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return v.IsZero()
+}
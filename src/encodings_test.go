@@ -0,0 +1,177 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const bigInt = int64(1)<<60 + 1 // not representable by a float64
+
+func callEncoded(databaseId string, body []byte, contentType, accept string, t *testing.T) (int, string, []byte) {
+	req, err := http.NewRequest("POST", "http://localhost:12321/"+databaseId, bytes.NewReader(body))
+	if err != nil {
+		t.Error(err)
+		return -1, "", nil
+	}
+	req.Header.Set("Content-Type", contentType)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return -1, "", nil
+	}
+	defer resp.Body.Close()
+
+	bs, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header.Get("Content-Type"), bs
+}
+
+func encodingsRequest() map[string]any {
+	return map[string]any{
+		"transaction": []any{
+			map[string]any{
+				"statement": "INSERT INTO T VALUES (:id, :blob)",
+				"values":    map[string]any{"id": bigInt, "blob": []byte{0, 1, 2}},
+			},
+			map[string]any{
+				"query":  "SELECT * FROM T WHERE ID = ?",
+				"values": []any{bigInt},
+			},
+		},
+	}
+}
+
+// Checks the result set of the second item, as decoded in a generic way
+func ckEncodingsResponse(res map[string]any, t *testing.T) {
+	results, _ := res["results"].([]any)
+	if len(results) != 2 {
+		t.Error("wrong results:", res)
+		return
+	}
+	item, _ := results[1].(map[string]any)
+	rows, _ := item["resultSet"].([]any)
+	if len(rows) != 1 {
+		t.Error("wrong result set:", item)
+		return
+	}
+	row, _ := rows[0].(map[string]any)
+	if reflect.ValueOf(row["ID"]).Convert(reflect.TypeFor[int64]()).Int() != bigInt {
+		t.Error("the integer is not exact:", row["ID"])
+	}
+	if !bytes.Equal(row["VAL"].([]byte), []byte{0, 1, 2}) {
+		t.Error("wrong blob:", row["VAL"])
+	}
+}
+
+func TestEncodingsSetup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:             "enc",
+				Path:           ":memory:",
+				InitStatements: []string{"CREATE TABLE T (ID INTEGER PRIMARY KEY, VAL BLOB)"},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestMsgpack(t *testing.T) {
+	body, _ := msgpack.Marshal(encodingsRequest())
+	code, ct, bs := callEncoded("enc", body, "application/msgpack", "", t)
+	if code != 200 || ct != "application/msgpack" {
+		t.Error("wrong response:", code, ct)
+		return
+	}
+
+	var res map[string]any
+	if err := msgpack.Unmarshal(bs, &res); err != nil {
+		t.Error(err)
+		return
+	}
+	ckEncodingsResponse(res, t)
+
+	// The order of the columns is kept
+	if !bytes.Contains(bs, []byte("\xa2ID")) || bytes.Index(bs, []byte("\xa2ID")) > bytes.Index(bs, []byte("\xa3VAL")) {
+		t.Error("wrong order of the columns")
+	}
+
+	_, _, _ = callEncoded("enc", []byte(`{"transaction":[{"statement":"DELETE FROM T"}]}`), "application/json", "", t)
+}
+
+func TestCBOR(t *testing.T) {
+	body, _ := cbor.Marshal(encodingsRequest())
+	code, ct, bs := callEncoded("enc", body, "application/cbor", "", t)
+	if code != 200 || ct != "application/cbor" {
+		t.Error("wrong response:", code, ct)
+		return
+	}
+
+	var res map[string]any
+	dm, _ := cbor.DecOptions{DefaultMapType: reflect.TypeFor[map[string]any]()}.DecMode()
+	if err := dm.Unmarshal(bs, &res); err != nil {
+		t.Error(err)
+		return
+	}
+	ckEncodingsResponse(res, t)
+}
+
+func TestEncodingsNegotiation(t *testing.T) {
+	// JSON request, MessagePack response
+	code, ct, bs := callEncoded("enc", []byte(`{"transaction":[{"query":"SELECT 1 AS ONE"}]}`), "application/json", "application/msgpack", t)
+	var res map[string]any
+	if code != 200 || ct != "application/msgpack" || msgpack.Unmarshal(bs, &res) != nil {
+		t.Error("wrong response:", code, ct)
+		return
+	}
+
+	// Errors too
+	body, _ := cbor.Marshal(map[string]any{"transaction": []any{map[string]any{"query": "SELECT * FROM NOPE"}}})
+	code, ct, bs = callEncoded("enc", body, "application/cbor", "", t)
+	var wse map[string]any
+	if code != 500 || ct != "application/cbor" || cbor.Unmarshal(bs, &wse) != nil || wse["error"] == "" {
+		t.Error("wrong error response:", code, ct)
+		return
+	}
+
+	// Tagged integer in JSON
+	code, _, bs = callEncoded("enc", []byte(`{"transaction":[{"query":"SELECT typeof(?) AS T","values":[{"$int":"1152921504606846977"}]}]}`), "application/json", "", t)
+	if code != 200 || !bytes.Contains(bs, []byte(`"integer"`)) {
+		t.Error("wrong tagged integer:", string(bs))
+	}
+}
+
+func TestEncodingsTeardown(t *testing.T) {
+	time.Sleep(time.Second)
+	Shutdown()
+}
@@ -0,0 +1,135 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Tells if a stored statement can be called with GET
+func isGetAllowed(db *db, statementId string) bool {
+	for i := range db.StoredStatement {
+		if db.StoredStatement[i].Id == statementId {
+			return db.StoredStatement[i].AllowGet
+		}
+	}
+	return false
+}
+
+func countGetStatements(db *db) int {
+	ret := 0
+	for i := range db.StoredStatement {
+		if db.StoredStatement[i].AllowGet {
+			ret++
+		}
+	}
+	return ret
+}
+
+// A query parameter is a string, unless it's the canonical representation of
+// a number: "12" is passed as a number, "012" as a string.
+func queryParam2value(param string) any {
+	if i, err := strconv.ParseInt(param, 10, 64); err == nil && strconv.FormatInt(i, 10) == param {
+		return i
+	}
+	if f, err := strconv.ParseFloat(param, 64); err == nil && strconv.FormatFloat(f, 'f', -1, 64) == param {
+		return f
+	}
+	return param
+}
+
+// Handler for the GET call of a stored statement, that must be enabled with
+// allowGet. The query parameters are passed as named parameters of the
+// statement, and the response is the same as for a POST request with one
+// query. Only statements that don't write can be executed; anyway, the
+// transaction is always rolled back.
+//
+// For INLINE auth, the credentials are in the Authorization header, as for
+// HTTP Basic auth.
+func getHandler(databaseId string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		db, err := lookupDb(databaseId)
+		if err != nil {
+			return err
+		}
+
+		statementId, err := url.PathUnescape(c.Params("statementId"))
+		if err != nil {
+			return newWSErrorf(-1, fiber.StatusBadRequest, "invalid URL path encoding: %s", err.Error())
+		}
+
+		// Execute non-concurrently
+		if err := lockDb(&db); err != nil {
+			return err
+		}
+		defer db.Mutex.Unlock()
+
+		if err := ckInlineAuthHeader(&db, c); err != nil {
+			return err
+		}
+
+		if !isGetAllowed(&db, statementId) {
+			return newWSErrorf(-1, fiber.StatusNotFound, "stored statement '%s' not found, or not callable with GET", statementId)
+		}
+
+		params := make(map[string]any)
+		for key, value := range c.Queries() {
+			params[key] = queryParam2value(value)
+		}
+		values, err := json.Marshal(params)
+		if err != nil {
+			return newWSError(-1, fiber.StatusInternalServerError, err.Error())
+		}
+
+		body := request{Transaction: []requestItem{{Query: "#" + statementId, Values: values}}}
+
+		ctx, cancel := newRequestContext(&db)
+		defer cancel()
+
+		// The driver doesn't enforce the ReadOnly of the transaction, so the
+		// connection is made query only: SQLite refuses any write, even by
+		// a trigger, and the statement fails.
+		if !db.ReadOnly {
+			if _, err := db.DbConn.ExecContext(ctx, "PRAGMA query_only = 1"); err != nil {
+				return newWSError(-1, fiber.StatusInternalServerError, err.Error())
+			}
+			defer db.DbConn.ExecContext(context.Background(), "PRAGMA query_only = 0")
+		}
+
+		var results []responseItem
+		err = retryOnBusy(ctx, &db, func() error {
+			tx, err := startTx(ctx, &db, "", true)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+
+			results, err = processItemsRecovering(ctx, &db, tx, &body, nil)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		return sendResponse(c, 200, response{Results: results})
+	}
+}
@@ -0,0 +1,179 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func callGet(path, user, password string, t *testing.T) (int, response) {
+	req, err := http.NewRequest("GET", "http://localhost:12321/"+path, nil)
+	if err != nil {
+		t.Error(err)
+		return -1, response{}
+	}
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return -1, response{}
+	}
+	defer resp.Body.Close()
+
+	var ret response
+	if resp.StatusCode == 200 {
+		bs, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(bs, &ret); err != nil {
+			t.Error(err)
+		}
+	}
+	return resp.StatusCode, ret
+}
+
+func TestGetSetup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:   "get",
+				Path: ":memory:",
+				InitStatements: []string{
+					"CREATE TABLE T (ID INT PRIMARY KEY, VAL TEXT)",
+					"INSERT INTO T VALUES (1, 'ONE'), (2, '02')",
+					"CREATE TABLE L (ID INT)",
+					"CREATE VIEW V AS SELECT ID FROM L",
+					"CREATE TRIGGER TR INSTEAD OF INSERT ON V BEGIN INSERT INTO L VALUES (NEW.ID); END",
+				},
+				StoredStatement: []storedStatement{
+					{Id: "byId", Sql: "SELECT VAL FROM T WHERE ID = :id", AllowGet: true},
+					{Id: "byVal", Sql: "SELECT ID FROM T WHERE VAL = :val", AllowGet: true},
+					{Id: "del", Sql: "DELETE FROM T RETURNING ID", AllowGet: true},
+					{Id: "trig", Sql: "INSERT INTO V VALUES (1)", AllowGet: true},
+					{Id: "all", Sql: "SELECT * FROM T"},
+				},
+			},
+			{
+				Id:   "getinline",
+				Path: ":memory:",
+				Auth: &authr{
+					Mode:          "INLINE",
+					ByCredentials: []credentialsCfg{{User: "pietro", Password: "hey"}},
+				},
+				StoredStatement: []storedStatement{{Id: "one", Sql: "SELECT 1 AS ONE", AllowGet: true}},
+			},
+			{
+				Id:   "gethttp",
+				Path: ":memory:",
+				Auth: &authr{
+					Mode:          "HTTP",
+					ByCredentials: []credentialsCfg{{User: "pietro", Password: "hey"}},
+				},
+				StoredStatement: []storedStatement{{Id: "one", Sql: "SELECT 1 AS ONE", AllowGet: true}},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestGet(t *testing.T) {
+	code, res := callGet("get/byId?id=1", "", "", t)
+	if code != 200 || len(res.Results[0].ResultSet) != 1 || getDefault[string](res.Results[0].ResultSet[0], "VAL") != "ONE" {
+		t.Error("wrong result")
+		return
+	}
+
+	// Not a number, because of the leading zero
+	code, res = callGet("get/byVal?val=02", "", "", t)
+	if code != 200 || len(res.Results[0].ResultSet) != 1 || getDefault[float64](res.Results[0].ResultSet[0], "ID") != 2 {
+		t.Error("wrong result")
+		return
+	}
+
+	code, _ = callGet("get/all", "", "", t)
+	if code != 404 {
+		t.Error("the statement was called without allowGet")
+		return
+	}
+
+	code, _ = callGet("get/nope", "", "", t)
+	if code != 404 {
+		t.Error("a non-existent statement was called")
+	}
+}
+
+func TestGetReadOnly(t *testing.T) {
+	code, _ := callGet("get/del", "", "", t)
+	if code == 200 {
+		t.Error("a statement that writes was executed")
+		return
+	}
+
+	code, _ = callGet("get/trig", "", "", t)
+	if code == 200 {
+		t.Error("a statement that writes with a trigger was executed")
+		return
+	}
+
+	code, _, ret := call("get", request{Transaction: []requestItem{{Query: "SELECT COUNT(1) AS C FROM T"}, {Query: "SELECT COUNT(1) AS C FROM L"}}}, t)
+	if code != 200 || getDefault[float64](ret.Results[0].ResultSet[0], "C") != 2 || getDefault[float64](ret.Results[1].ResultSet[0], "C") != 0 {
+		t.Error("the database was modified")
+		return
+	}
+
+	// The connection can write again
+	code, _, _ = call("get", request{Transaction: []requestItem{{Statement: "INSERT INTO L VALUES (1)"}, {Statement: "DELETE FROM L"}}}, t)
+	if code != 200 {
+		t.Error("the database remained query only")
+	}
+}
+
+func TestGetAuth(t *testing.T) {
+	for _, dbId := range []string{"getinline", "gethttp"} {
+		code, _ := callGet(dbId+"/one", "", "", t)
+		if code != 401 {
+			t.Error("called without credentials on", dbId)
+			return
+		}
+
+		code, _ = callGet(dbId+"/one", "pietro", "ho", t)
+		if code != 401 {
+			t.Error("called with wrong credentials on", dbId)
+			return
+		}
+
+		code, res := callGet(dbId+"/one", "pietro", "hey", t)
+		if code != 200 || getDefault[float64](res.Results[0].ResultSet[0], "ONE") != 1 {
+			t.Error("failed with right credentials on", dbId)
+			return
+		}
+	}
+}
+
+func TestGetTeardown(t *testing.T) {
+	time.Sleep(time.Second)
+	Shutdown()
+}
@@ -0,0 +1,157 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// With idempotency, a request can carry a key, in the Idempotency-Key header
+// or in the idempotencyKey field. The response of a successful transaction is
+// recorded with its key, in the same transaction; a request with the same key
+// gets the recorded response, without being executed again. The records are
+// kept in a table of the database, and expire after the retention time.
+//
+// The key is bound to the body of the request: reusing it for a different
+// one is an error. It's not accepted for streamed results and cursors.
+
+const (
+	idempotencyTable                = "_ws4sqlite_idempotency"
+	idempotencyHeader               = "Idempotency-Key"
+	idempotencyReplayed             = "Idempotent-Replayed"
+	idempotencyMaxKeyLen            = 255
+	defaultIdempotencyRetentionSecs = 24 * 60 * 60
+)
+
+const idempotencyDDL = `CREATE TABLE IF NOT EXISTS ` + idempotencyTable + ` (
+	key TEXT PRIMARY KEY,
+	fingerprint TEXT NOT NULL,
+	status INTEGER NOT NULL,
+	content_type TEXT NOT NULL,
+	response BLOB NOT NULL,
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS ` + idempotencyTable + `_created_at ON ` + idempotencyTable + ` (created_at)`
+
+type idempotentRequest struct {
+	Key         string
+	Fingerprint string            // hash of the body
+	Recorded    *renderedResponse // after the transaction, if it was recorded
+}
+
+// Creates the table for the records, if needed
+func initIdempotency(db *db) error {
+	_, err := db.DbConn.ExecContext(context.Background(), idempotencyDDL)
+	return err
+}
+
+// Returns the key of the request, or nil if it has none
+func newIdempotentRequest(c *fiber.Ctx, db *db, body *request) (*idempotentRequest, error) {
+	key := c.Get(idempotencyHeader)
+	if key == "" {
+		key = body.IdempotencyKey
+	} else if body.IdempotencyKey != "" && body.IdempotencyKey != key {
+		return nil, newWSError(-1, fiber.StatusBadRequest, "the idempotency key in the header and in the request are different")
+	}
+
+	if key == "" {
+		return nil, nil
+	}
+	if !db.Idempotency {
+		return nil, newWSError(-1, fiber.StatusBadRequest, "idempotency keys are not enabled for this database")
+	}
+	if len(key) > idempotencyMaxKeyLen {
+		return nil, newWSErrorf(-1, fiber.StatusBadRequest, "the idempotency key cannot be longer than %d characters", idempotencyMaxKeyLen)
+	}
+	// The response would not be recorded: the rows are streamed, or served
+	// by a cursor that a retry would open again
+	if body.ResultFormat != nil && strings.EqualFold(*body.ResultFormat, resultFormatNDJSONStream) {
+		return nil, newWSError(-1, fiber.StatusBadRequest, "idempotency keys are not supported with a streamed result")
+	}
+	if body.Transaction[0].PageSize != 0 {
+		return nil, newWSError(-1, fiber.StatusBadRequest, "idempotency keys are not supported when opening a cursor")
+	}
+
+	hash := sha256.Sum256(c.Body())
+	return &idempotentRequest{Key: key, Fingerprint: hex.EncodeToString(hash[:])}, nil
+}
+
+// Looks for the recorded response of a previous request with the same key.
+// The caller must hold the mutex of the database.
+func (ir *idempotentRequest) lookup(db *db) (*renderedResponse, error) {
+	var ret renderedResponse
+	var fingerprint string
+	err := db.DbConn.QueryRowContext(context.Background(),
+		"SELECT fingerprint, status, content_type, response FROM "+idempotencyTable+" WHERE key = ? AND created_at > ?",
+		ir.Key, time.Now().Unix()-int64(db.IdempotencyRetentionSecs)).Scan(&fingerprint, &ret.Status, &ret.ContentType, &ret.Body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, newWSError(-1, fiber.StatusInternalServerError, err.Error())
+	}
+
+	if fingerprint != ir.Fingerprint {
+		return nil, newWSError(-1, fiber.StatusUnprocessableEntity, "the idempotency key was already used for a different request")
+	}
+	return &ret, nil
+}
+
+// Records the response in the transaction, removing the expired ones
+func (ir *idempotentRequest) record(ctx context.Context, tx dbTx, db *db, resp *renderedResponse) error {
+	now := time.Now().Unix()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+idempotencyTable+" WHERE created_at <= ?", now-int64(db.IdempotencyRetentionSecs)); err != nil {
+		return newWSError(-1, fiber.StatusInternalServerError, err.Error())
+	}
+	if _, err := tx.ExecContext(ctx,
+		"INSERT OR REPLACE INTO "+idempotencyTable+" (key, fingerprint, status, content_type, response, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		ir.Key, ir.Fingerprint, resp.Status, resp.ContentType, resp.Body, now); err != nil {
+		return newWSError(-1, fiber.StatusInternalServerError, err.Error())
+	}
+	return nil
+}
+
+// Returns a function for runTransaction(), that renders the response and
+// records it before the commit. The request can be nil, i.e. without a key.
+func (ir *idempotentRequest) recorder(db *db, render func([]responseItem) (*renderedResponse, error)) func(context.Context, dbTx, []responseItem) error {
+	if ir == nil {
+		return nil
+	}
+	return func(ctx context.Context, tx dbTx, results []responseItem) error {
+		resp, err := render(results)
+		if err != nil {
+			return err
+		}
+		if err := ir.record(ctx, tx, db, resp); err != nil {
+			return err
+		}
+		ir.Recorded = resp
+		return nil
+	}
+}
+
+func sendReplayed(c *fiber.Ctx, resp *renderedResponse) error {
+	c.Set(idempotencyReplayed, "true")
+	return sendRendered(c, resp)
+}
@@ -0,0 +1,215 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func callIdempotent(databaseId, key string, req request, t *testing.T) (int, bool, []byte) {
+	body, _ := json.Marshal(req)
+	hreq, err := http.NewRequest("POST", "http://localhost:12321/"+databaseId, bytes.NewReader(body))
+	if err != nil {
+		t.Error(err)
+		return -1, false, nil
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		hreq.Header.Set(idempotencyHeader, key)
+	}
+
+	resp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		t.Error(err)
+		return -1, false, nil
+	}
+	defer resp.Body.Close()
+
+	bs, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header.Get(idempotencyReplayed) == "true", bs
+}
+
+func countIdempotent(databaseId string, t *testing.T) float64 {
+	_, _, res := call(databaseId, request{Transaction: []requestItem{{Query: "SELECT COUNT(1) AS C FROM T"}}}, t)
+	return getDefault[float64](res.Results[0].ResultSet[0], "C")
+}
+
+func TestIdempotencySetup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:             "idem",
+				Path:           ":memory:",
+				Idempotency:    true,
+				InitStatements: []string{"CREATE TABLE T (ID INTEGER PRIMARY KEY, VAL TEXT)"},
+			},
+			{
+				Id:                       "idemshort",
+				Path:                     ":memory:",
+				Idempotency:              true,
+				IdempotencyRetentionSecs: 1,
+				InitStatements:           []string{"CREATE TABLE T (ID INTEGER PRIMARY KEY, VAL TEXT)"},
+			},
+			{
+				Id:             "noidem",
+				Path:           ":memory:",
+				InitStatements: []string{"CREATE TABLE T (ID INTEGER PRIMARY KEY, VAL TEXT)"},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	req := request{Transaction: []requestItem{{Query: "INSERT INTO T (VAL) VALUES ('A') RETURNING ID, VAL"}}}
+
+	code, replayed, first := callIdempotent("idem", "key1", req, t)
+	if code != 200 || replayed {
+		t.Error("wrong first response", code, string(first))
+		return
+	}
+
+	code, replayed, second := callIdempotent("idem", "key1", req, t)
+	if code != 200 || !replayed || !bytes.Equal(first, second) {
+		t.Error("the response was not replayed", code, string(second))
+		return
+	}
+
+	if countIdempotent("idem", t) != 1 {
+		t.Error("the transaction was executed twice")
+		return
+	}
+
+	// The key can also be in the request
+	req.IdempotencyKey = "key2"
+	if code, replayed, _ = callIdempotent("idem", "", req, t); code != 200 || replayed {
+		t.Error("wrong response for the key in the request", code)
+		return
+	}
+	if code, replayed, _ = callIdempotent("idem", "key2", req, t); code != 200 || !replayed {
+		t.Error("the response was not replayed with the key in the request", code)
+		return
+	}
+	if code, _, _ = callIdempotent("idem", "other", req, t); code != 400 {
+		t.Error("different keys in the header and in the request were accepted", code)
+		return
+	}
+
+	if countIdempotent("idem", t) != 2 {
+		t.Error("wrong number of rows")
+	}
+}
+
+func TestIdempotencyV2(t *testing.T) {
+	req := request{Version: 2, Transaction: []requestItem{{Statement: "INSERT INTO T (VAL) VALUES ('B')"}}}
+
+	code, _, first := callIdempotent("idem", "keyV2", req, t)
+	code2, replayed, second := callIdempotent("idem", "keyV2", req, t)
+	if code != 200 || code2 != 200 || !replayed || !bytes.Equal(first, second) {
+		t.Error("the v2 response was not replayed", code, code2, string(second))
+	}
+}
+
+func TestIdempotencyFailedNotRecorded(t *testing.T) {
+	req := request{Transaction: []requestItem{{Statement: "INSERT INTO NOPE VALUES (1)"}}}
+
+	code, _, _ := callIdempotent("idem", "keyFail", req, t)
+	code2, replayed, _ := callIdempotent("idem", "keyFail", req, t)
+	if code == 200 || code2 != code || replayed {
+		t.Error("a failed transaction was recorded", code, code2)
+	}
+}
+
+func TestIdempotencyDryRunNotRecorded(t *testing.T) {
+	req := request{DryRun: true, Transaction: []requestItem{{Statement: "INSERT INTO T (VAL) VALUES ('C')"}}}
+
+	callIdempotent("idem", "keyDry", req, t)
+	code, replayed, _ := callIdempotent("idem", "keyDry", req, t)
+	if code != 200 || replayed {
+		t.Error("a dry run was recorded", code)
+	}
+}
+
+func TestIdempotencyMismatch(t *testing.T) {
+	callIdempotent("idem", "keyMis", request{Transaction: []requestItem{{Statement: "INSERT INTO T (VAL) VALUES ('D')"}}}, t)
+
+	code, _, _ := callIdempotent("idem", "keyMis", request{Transaction: []requestItem{{Statement: "INSERT INTO T (VAL) VALUES ('E')"}}}, t)
+	if code != 422 {
+		t.Error("the key was reused for a different request", code)
+	}
+}
+
+func TestIdempotencyUnsupported(t *testing.T) {
+	code, _, _ := callIdempotent("idem", "keyCur", request{Transaction: []requestItem{{Query: "SELECT 1", PageSize: 1}}}, t)
+	if code != 400 {
+		t.Error("the key was accepted when opening a cursor", code)
+	}
+
+	stream := resultFormatNDJSONStream
+	code, _, _ = callIdempotent("idem", "keyStream", request{ResultFormat: &stream, Transaction: []requestItem{{Query: "SELECT 1"}}}, t)
+	if code != 400 {
+		t.Error("the key was accepted with a streamed result", code)
+	}
+}
+
+func TestIdempotencyNotEnabled(t *testing.T) {
+	code, _, _ := callIdempotent("noidem", "key1", request{Transaction: []requestItem{{Query: "SELECT 1"}}}, t)
+	if code != 400 {
+		t.Error("the key was accepted on a database without idempotency", code)
+	}
+}
+
+func TestIdempotencyTable(t *testing.T) {
+	code, _, _ := callIdempotent("idem", "", request{Transaction: []requestItem{{Query: "SELECT COUNT(1) FROM " + idempotencyTable}}}, t)
+	if code != 200 {
+		t.Error("the table of the records was not created", code)
+	}
+}
+
+func TestIdempotencyRetention(t *testing.T) {
+	req := request{Transaction: []requestItem{{Statement: "INSERT INTO T (VAL) VALUES ('A')"}}}
+
+	callIdempotent("idemshort", "key1", req, t)
+	if _, replayed, _ := callIdempotent("idemshort", "key1", req, t); !replayed {
+		t.Error("the response was not replayed")
+		return
+	}
+
+	time.Sleep(2 * time.Second)
+
+	if _, replayed, _ := callIdempotent("idemshort", "key1", req, t); replayed {
+		t.Error("an expired response was replayed")
+		return
+	}
+	if countIdempotent("idemshort", t) != 2 {
+		t.Error("wrong number of rows")
+	}
+}
+
+func TestIdempotencyTeardown(t *testing.T) {
+	time.Sleep(time.Second)
+	Shutdown()
+}
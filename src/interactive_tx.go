@@ -0,0 +1,329 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+const (
+	defaultInteractiveTxIdleSecs = 30
+	defaultInteractiveTxMaxSecs  = 300
+)
+
+// An interactive transaction spans several HTTP requests: it's opened with a
+// call, then the client sends batches of items against it, and finally commits
+// or rolls it back.
+//
+// Each database has only one connection, so while the transaction is open it
+// "owns" the database: it holds its mutex, and the other requests fail at
+// once with a 409 (see lockDb()), rather than waiting for it. If the client
+// doesn't send anything for a while, or the transaction is open for too long
+// anyway, it's rolled back and the database is released.
+type interactiveTx struct {
+	Id          string
+	Db          *db
+	Tx          dbTx
+	Mutex       sync.Mutex // serializes the calls on this transaction
+	Timer       *time.Timer
+	Deadline    time.Time
+	MaxDeadline time.Time // the deadline can't be postponed after this
+	Closed      bool
+}
+
+var interactiveTxs = make(map[string]*interactiveTx)
+var interactiveTxsMutex sync.Mutex
+
+func (itx *interactiveTx) idleTimeout() time.Duration {
+	return time.Duration(itx.Db.InteractiveTxIdleSecs) * time.Second
+}
+
+// Postpones the idle timeout, to be called when the transaction is used. It
+// can't go beyond the maximum lifetime of the transaction.
+func (itx *interactiveTx) touch() {
+	itx.Deadline = time.Now().Add(itx.idleTimeout())
+	if itx.Deadline.After(itx.MaxDeadline) {
+		itx.Deadline = itx.MaxDeadline
+	}
+	itx.Timer.Reset(time.Until(itx.Deadline))
+}
+
+// Tells if the database is held by an interactive transaction
+func hasInteractiveTx(db *db) bool {
+	interactiveTxsMutex.Lock()
+	defer interactiveTxsMutex.Unlock()
+
+	for _, itx := range interactiveTxs {
+		if itx.Db.Id == db.Id {
+			return true
+		}
+	}
+	return false
+}
+
+// Called by the timer. It may fire while a call is being served, and then find
+// that the deadline was postponed; in that case it just re-arms itself.
+func (itx *interactiveTx) expire() {
+	itx.Mutex.Lock()
+	defer itx.Mutex.Unlock()
+
+	if itx.Closed {
+		return
+	}
+
+	if remaining := time.Until(itx.Deadline); remaining > 0 {
+		itx.Timer.Reset(remaining)
+		return
+	}
+
+	mllog.Warnf("interactive transaction on '%s' expired, rolling back", itx.Db.Id)
+	itx.end(false)
+}
+
+// Commits or rolls back the transaction, and releases the database. The caller
+// must hold the mutex of the transaction.
+func (itx *interactiveTx) end(commit bool) error {
+	itx.Closed = true
+	itx.Timer.Stop()
+
+	interactiveTxsMutex.Lock()
+	delete(interactiveTxs, itx.Id)
+	interactiveTxsMutex.Unlock()
+
+	defer itx.Db.Mutex.Unlock()
+
+	if commit {
+		return commitTx(context.Background(), itx.Db, itx.Tx)
+	}
+	return itx.Tx.Rollback()
+}
+
+func genTxId() (string, error) {
+	bs := make([]byte, 16)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bs), nil
+}
+
+// Opens a transaction, that holds the database until it's closed. The caller
+// must hold the mutex of the database, that is transferred to the transaction.
+// If the mode is empty, the one of the database is used.
+func beginInteractiveTx(db *db, mode string) (*interactiveTx, error) {
+	id, err := genTxId()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := startTx(context.Background(), db, mode, db.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	itx := &interactiveTx{Id: id, Db: db, Tx: tx}
+	itx.MaxDeadline = time.Now().Add(time.Duration(db.InteractiveTxMaxSecs) * time.Second)
+	itx.Timer = time.AfterFunc(itx.idleTimeout(), itx.expire)
+	itx.touch()
+
+	interactiveTxsMutex.Lock()
+	interactiveTxs[id] = itx
+	interactiveTxsMutex.Unlock()
+
+	return itx, nil
+}
+
+// Retrieves an open transaction, and locks it. The caller must unlock it.
+func lockInteractiveTx(db *db, txId string) (*interactiveTx, error) {
+	interactiveTxsMutex.Lock()
+	itx, found := interactiveTxs[txId]
+	interactiveTxsMutex.Unlock()
+
+	if found {
+		itx.Mutex.Lock()
+		if !itx.Closed && itx.Db.Id == db.Id {
+			return itx, nil
+		}
+		itx.Mutex.Unlock()
+	}
+
+	return nil, newWSErrorf(-1, fiber.StatusNotFound, "transaction '%s' not found (expired?)", txId)
+}
+
+// Executes a batch of items in the transaction. If it fails, the transaction
+// is rolled back and closed. The caller must hold the mutex of the transaction.
+func (itx *interactiveTx) processBatch(body *request) ([]responseItem, error) {
+	if len(body.Transaction) == 0 {
+		return nil, newWSError(-1, fiber.StatusBadRequest, "missing statements list ('transaction' node)")
+	}
+
+	if err := ckRequestOptions(body); err != nil {
+		return nil, err
+	}
+
+	if body.DryRun {
+		return nil, newWSError(-1, fiber.StatusBadRequest, "dryRun is not supported in interactive transactions")
+	}
+
+	if body.Version == protocolV2 {
+		return nil, newWSError(-1, fiber.StatusBadRequest, "version 2 of the protocol is not supported in interactive transactions")
+	}
+
+	if body.ResultFormat != nil &&
+		(strings.EqualFold(*body.ResultFormat, resultFormatNDJSONStream) || strings.EqualFold(*body.ResultFormat, resultFormatCSV)) {
+		return nil, newWSErrorf(-1, fiber.StatusBadRequest, "result format '%s' is not supported in interactive transactions", *body.ResultFormat)
+	}
+
+	itx.touch()
+
+	// The timeout applies to each batch, not to the whole transaction
+	ctx, cancel := newRequestContext(itx.Db)
+	defer cancel()
+
+	results, err := processItemsRecovering(ctx, itx.Db, itx.Tx, body, nil)
+	if err != nil {
+		itx.end(false)
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// Handler for the call that opens a transaction. The body can be empty, or
+// contain only the credentials (for INLINE auth). Responds with the ID of
+// the transaction, to use in the URL of the subsequent calls.
+func beginTxHandler(databaseId string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		var body request
+		if len(c.Body()) > 0 {
+			if err := parseBody(c, &body); err != nil {
+				return newWSErrorf(-1, fiber.StatusBadRequest, "in parsing body: %s", err.Error())
+			}
+		}
+
+		db, err := lookupDb(databaseId)
+		if err != nil {
+			return err
+		}
+
+		// Waits for the database to be free; if all goes well, the lock
+		// is not released here but when the transaction ends.
+		if err := lockDb(&db); err != nil {
+			return err
+		}
+
+		if err := ckInlineAuth(&db, &body); err != nil {
+			db.Mutex.Unlock()
+			return err
+		}
+
+		txMode, err := parseTxMode(body.TxMode)
+		if err != nil {
+			db.Mutex.Unlock()
+			return newWSError(-1, fiber.StatusBadRequest, err.Error())
+		}
+
+		itx, err := beginInteractiveTx(&db, txMode)
+		if err != nil {
+			db.Mutex.Unlock()
+			return err
+		}
+
+		return sendResponse(c, 200, interactiveTxResponse{TxId: itx.Id, Success: true})
+	}
+}
+
+// Handler for a batch of items, to execute in an open transaction. The body
+// is the same as for a "normal" request, and so is the response. If the
+// batch fails, the transaction is rolled back and closed, as it would be for
+// a normal request.
+func txBatchHandler(databaseId string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		var body request
+		if err := parseBody(c, &body); err != nil {
+			return newWSErrorf(-1, fiber.StatusBadRequest, "in parsing body: %s", err.Error())
+		}
+
+		db, err := lookupDb(databaseId)
+		if err != nil {
+			return err
+		}
+
+		itx, err := lockInteractiveTx(&db, c.Params("txId"))
+		if err != nil {
+			return err
+		}
+		defer itx.Mutex.Unlock()
+
+		// The mutex of the database is held by the transaction, so the wait
+		// after a failed auth is serialized by the one of the transaction
+		if err := ckInlineAuth(&db, &body); err != nil {
+			return err
+		}
+
+		results, err := itx.processBatch(&body)
+		if err != nil {
+			return err
+		}
+
+		return sendResponse(c, 200, response{Results: results})
+	}
+}
+
+// Handler for the calls that close a transaction, committing it or
+// rolling it back. The body can be empty, or contain only the credentials
+// (for INLINE auth).
+func endTxHandler(databaseId string, commit bool) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		var body request
+		if len(c.Body()) > 0 {
+			if err := parseBody(c, &body); err != nil {
+				return newWSErrorf(-1, fiber.StatusBadRequest, "in parsing body: %s", err.Error())
+			}
+		}
+
+		db, err := lookupDb(databaseId)
+		if err != nil {
+			return err
+		}
+
+		itx, err := lockInteractiveTx(&db, c.Params("txId"))
+		if err != nil {
+			return err
+		}
+		defer itx.Mutex.Unlock()
+
+		// The mutex of the database is held by the transaction, so the wait
+		// after a failed auth is serialized by the one of the transaction
+		if err := ckInlineAuth(&db, &body); err != nil {
+			return err
+		}
+
+		if err := itx.end(commit); err != nil {
+			return newWSError(-1, fiber.StatusInternalServerError, err.Error())
+		}
+
+		return sendResponse(c, 200, interactiveTxResponse{TxId: itx.Id, Success: true})
+	}
+}
@@ -0,0 +1,240 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+func beginTx(databaseId string, t *testing.T) string {
+	code, body := callRawBA(databaseId+"/tx", request{}, "", "", t)
+	if code != 200 {
+		t.Error("could not begin transaction:", string(body))
+		return ""
+	}
+	var res interactiveTxResponse
+	if err := json.Unmarshal(body, &res); err != nil || !res.Success || res.TxId == "" {
+		t.Error("wrong response to begin:", string(body))
+		return ""
+	}
+	return res.TxId
+}
+
+func countITX(t *testing.T) int {
+	code, _, res := call("itx", request{Transaction: []requestItem{{Query: "SELECT COUNT(1) AS C FROM T"}}}, t)
+	if code != 200 {
+		t.Error("could not count")
+		return -1
+	}
+	return int(getDefault[float64](res.Results[0].ResultSet[0], "C"))
+}
+
+func TestITXSetup(t *testing.T) {
+	os.Remove("../test/itx.db")
+	os.Remove("../test/noitx.db")
+
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:                    "itx",
+				Path:                  "../test/itx.db",
+				InteractiveTx:         true,
+				InteractiveTxIdleSecs: 1,
+				InitStatements: []string{
+					"CREATE TABLE T (ID INT PRIMARY KEY, VAL TEXT)",
+				},
+			},
+			{
+				Id:                    "itxmax",
+				Path:                  ":memory:",
+				InteractiveTx:         true,
+				InteractiveTxIdleSecs: 1,
+				InteractiveTxMaxSecs:  2,
+			},
+			{
+				Id:   "noitx",
+				Path: "../test/noitx.db",
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestITXCommit(t *testing.T) {
+	txId := beginTx("itx", t)
+
+	code, _, res := call("itx/tx/"+txId, request{Transaction: []requestItem{{Statement: "INSERT INTO T VALUES (1, 'ONE')"}}}, t)
+	if code != 200 || !res.Results[0].Success {
+		t.Error("insert failed")
+		return
+	}
+
+	code, _, res = call("itx/tx/"+txId, request{Transaction: []requestItem{{Query: "SELECT VAL FROM T WHERE ID = 1"}}}, t)
+	if code != 200 || getDefault[string](res.Results[0].ResultSet[0], "VAL") != "ONE" {
+		t.Error("the transaction doesn't see its own insert")
+		return
+	}
+
+	// The other requests fail at once, while the transaction is open
+	code, _, _ = call("itx", request{Transaction: []requestItem{{Query: "SELECT 1"}}}, t)
+	if code != 409 {
+		t.Error("a request was served while a transaction was open", code)
+		return
+	}
+	code, _ = callRawBA("itx/tx", request{}, "", "", t)
+	if code != 409 {
+		t.Error("a transaction was opened while another one was open", code)
+		return
+	}
+
+	code, _ = callRawBA("itx/tx/"+txId+"/commit", request{}, "", "", t)
+	if code != 200 {
+		t.Error("commit failed")
+		return
+	}
+
+	if countITX(t) != 1 {
+		t.Error("the insert was not committed")
+	}
+
+	// The transaction is closed now
+	code, _ = callRawBA("itx/tx/"+txId+"/commit", request{}, "", "", t)
+	if code != 404 {
+		t.Error("the transaction is still there")
+	}
+}
+
+func TestITXRollback(t *testing.T) {
+	txId := beginTx("itx", t)
+
+	code, _, _ := call("itx/tx/"+txId, request{Transaction: []requestItem{{Statement: "INSERT INTO T VALUES (2, 'TWO')"}}}, t)
+	if code != 200 {
+		t.Error("insert failed")
+		return
+	}
+
+	code, _ = callRawBA("itx/tx/"+txId+"/rollback", request{}, "", "", t)
+	if code != 200 {
+		t.Error("rollback failed")
+		return
+	}
+
+	if countITX(t) != 1 {
+		t.Error("the insert was not rolled back")
+	}
+}
+
+func TestITXFailedBatch(t *testing.T) {
+	txId := beginTx("itx", t)
+
+	code, _, _ := call("itx/tx/"+txId, request{Transaction: []requestItem{{Statement: "INSERT INTO T VALUES (2, 'TWO')"}}}, t)
+	if code != 200 {
+		t.Error("insert failed")
+		return
+	}
+
+	code, _, _ = call("itx/tx/"+txId, request{Transaction: []requestItem{{Statement: "INSERT INTO T VALUES (2, 'TWO')"}}}, t)
+	if code != 500 {
+		t.Error("duplicate insert succeeded")
+		return
+	}
+
+	// A failure ends the transaction
+	code, _, _ = call("itx/tx/"+txId, request{Transaction: []requestItem{{Query: "SELECT 1"}}}, t)
+	if code != 404 {
+		t.Error("the transaction is still there")
+		return
+	}
+
+	if countITX(t) != 1 {
+		t.Error("the insert was not rolled back")
+	}
+}
+
+func TestITXIdleTimeout(t *testing.T) {
+	txId := beginTx("itx", t)
+
+	code, _, _ := call("itx/tx/"+txId, request{Transaction: []requestItem{{Statement: "INSERT INTO T VALUES (3, 'THREE')"}}}, t)
+	if code != 200 {
+		t.Error("insert failed")
+		return
+	}
+
+	// Using it postpones the timeout
+	time.Sleep(700 * time.Millisecond)
+	code, _, _ = call("itx/tx/"+txId, request{Transaction: []requestItem{{Query: "SELECT 1"}}}, t)
+	if code != 200 {
+		t.Error("the transaction expired too early")
+		return
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	code, _ = callRawBA("itx/tx/"+txId+"/commit", request{}, "", "", t)
+	if code != 404 {
+		t.Error("the transaction didn't expire")
+		return
+	}
+
+	if countITX(t) != 1 {
+		t.Error("the insert was not rolled back")
+	}
+}
+
+func TestITXMaxDuration(t *testing.T) {
+	txId := beginTx("itxmax", t)
+
+	// Using it doesn't postpone the timeout beyond the maximum duration
+	for i := 0; i < 5; i++ {
+		time.Sleep(500 * time.Millisecond)
+		code, _, _ := call("itxmax/tx/"+txId, request{Transaction: []requestItem{{Query: "SELECT 1"}}}, t)
+		if i < 3 && code != 200 {
+			t.Error("the transaction expired too early", code)
+			return
+		}
+		if i == 4 && code != 404 {
+			t.Error("the transaction didn't expire", code)
+			return
+		}
+	}
+
+	// The database is free again
+	if code, _, _ := call("itxmax", request{Transaction: []requestItem{{Query: "SELECT 1"}}}, t); code != 200 {
+		t.Error("the database was not released", code)
+	}
+}
+
+func TestITXNotEnabled(t *testing.T) {
+	code, _ := callRawBA("noitx/tx", request{}, "", "", t)
+	if code != 404 && code != 405 {
+		t.Error("interactive transactions should not be enabled")
+	}
+}
+
+func TestITXTeardown(t *testing.T) {
+	time.Sleep(time.Second)
+	Shutdown()
+	os.Remove("../test/itx.db")
+	os.Remove("../test/noitx.db")
+}
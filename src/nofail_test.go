@@ -0,0 +1,92 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestNoFailSetup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:             "nofail",
+				Path:           ":memory:",
+				InitStatements: []string{"CREATE TABLE T (ID INT PRIMARY KEY)", "INSERT INTO T VALUES (1)"},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func countNoFail(t *testing.T) float64 {
+	_, _, res := call("nofail", request{Transaction: []requestItem{{Query: "SELECT COUNT(1) AS C FROM T"}}}, t)
+	return getDefault[float64](res.Results[0].ResultSet[0], "C")
+}
+
+func TestNoFailBatchRolledBack(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			{
+				Statement:   "INSERT INTO T VALUES (:id)",
+				ValuesBatch: []json.RawMessage{mkRaw(map[string]any{"id": 2}), mkRaw(map[string]any{"id": 1})},
+				NoFail:      true,
+			},
+			{Statement: "INSERT INTO T VALUES (3)"},
+		},
+	}
+	code, _, res := call("nofail", req, t)
+	if code != 200 || res.Results[0].Success || !res.Results[1].Success {
+		t.Error("wrong result", code)
+		return
+	}
+
+	// The first row of the batch was rolled back, the other item committed
+	if countNoFail(t) != 2 {
+		t.Error("the failed item left some changes")
+	}
+}
+
+func TestNoFailStatementRolledBack(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			// With OR FAIL, SQLite keeps the rows inserted before the failure
+			{Statement: "INSERT OR FAIL INTO T VALUES (4), (1)", NoFail: true},
+			{Statement: "INSERT INTO T VALUES (5)", NoFail: true},
+		},
+	}
+	code, _, res := call("nofail", req, t)
+	if code != 200 || res.Results[0].Success || !res.Results[1].Success {
+		t.Error("wrong result", code)
+		return
+	}
+
+	if countNoFail(t) != 3 {
+		t.Error("the failed item left some changes")
+	}
+}
+
+func TestNoFailTeardown(t *testing.T) {
+	time.Sleep(time.Second)
+	Shutdown()
+}
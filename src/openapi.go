@@ -0,0 +1,402 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/iancoleman/orderedmap"
+)
+
+// With the --openapi commandline parameter, an OpenAPI 3 document that
+// describes the served databases is available at GET /openapi.json. It's
+// generated at startup from the configuration: for each database, it
+// describes the endpoints that are enabled, their authentication and the
+// stored statements (without their SQL), with the named parameters found in
+// them. The schemas of the requests and responses are generated from the Go
+// structures.
+//
+// The document is served without authentication, for all the databases; so
+// it's generated only when asked for, as it lists the IDs and the parameters
+// of the stored statements.
+
+const openAPIPath = "/openapi.json"
+
+// The structures that are described in components/schemas, with their names
+var openAPISchemas = map[reflect.Type]string{
+	reflect.TypeFor[credentials]():           "credentials",
+	reflect.TypeFor[csvOptions]():            "csvOptions",
+	reflect.TypeFor[requestItem]():           "requestItem",
+	reflect.TypeFor[request]():               "request",
+	reflect.TypeFor[resultType]():            "resultType",
+	reflect.TypeFor[responseItem]():          "responseItem",
+	reflect.TypeFor[response]():              "response",
+	reflect.TypeFor[wsError]():               "error",
+	reflect.TypeFor[errorV2]():               "errorV2",
+	reflect.TypeFor[responseItemV2]():        "responseItemV2",
+	reflect.TypeFor[responseV2]():            "responseV2",
+	reflect.TypeFor[interactiveTxResponse](): "txResponse",
+	reflect.TypeFor[cursorResponse]():        "cursorResponse",
+	reflect.TypeFor[schemaResponse]():        "schemaResponse",
+	reflect.TypeFor[changeEvent]():           "changeEvent",
+}
+
+func schemaRef(name string) map[string]any {
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+// Builds the JSON schema of a type, following the "json" tags for the structs
+func schemaOf(t reflect.Type, inline bool) map[string]any {
+	switch t {
+	case reflect.TypeFor[json.RawMessage](), reflect.TypeFor[any]():
+		return map[string]any{} // any JSON value
+	case reflect.TypeFor[orderedmap.OrderedMap]():
+		return map[string]any{"type": "object"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(t.Elem(), false)
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), false)}
+	case reflect.Map:
+		return map[string]any{"type": "object"}
+	case reflect.Struct:
+		if name, found := openAPISchemas[t]; found && !inline {
+			return schemaRef(name)
+		}
+		props := make(map[string]any)
+		// The fields of an embedded struct are added first, so that the ones
+		// of the outer struct shadow them
+		for i := 0; i < t.NumField(); i++ {
+			if field := t.Field(i); field.Anonymous && field.Tag.Get("json") == "" {
+				for name, prop := range schemaOf(field.Type, true)["properties"].(map[string]any) {
+					props[name] = prop
+				}
+			}
+		}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			props[name] = schemaOf(field.Type, false)
+		}
+		return map[string]any{"type": "object", "properties": props}
+	}
+	return map[string]any{}
+}
+
+// Finds the named parameters (:name, @name or $name) in a SQL string, skipping
+// the literals, the quoted identifiers and the comments. They are returned
+// without the prefix, in order of appearance and without duplicates.
+func namedParams(sql string) []string {
+	ret := []string{}
+	skipTo := func(i int, end string) int {
+		if idx := strings.Index(sql[i:], end); idx >= 0 {
+			return i + idx + len(end) - 1
+		}
+		return len(sql)
+	}
+	for i := 0; i < len(sql); i++ {
+		switch c := sql[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			i = skipTo(i+1, string(c))
+		case c == '[':
+			i = skipTo(i+1, "]")
+		case strings.HasPrefix(sql[i:], "--"):
+			i = skipTo(i+2, "\n")
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = skipTo(i+2, "*/")
+		case c == ':' || c == '@' || c == '$':
+			j := i + 1
+			for j < len(sql) && (sql[j] == '_' || sql[j] >= 'a' && sql[j] <= 'z' || sql[j] >= 'A' && sql[j] <= 'Z' || sql[j] >= '0' && sql[j] <= '9') {
+				j++
+			}
+			if name := sql[i+1 : j]; name != "" && !slices.Contains(ret, name) {
+				ret = append(ret, name)
+			}
+			i = j - 1
+		}
+	}
+	return ret
+}
+
+// The content of a body that can be encoded in JSON, MessagePack or CBOR (see
+// encodings.go), with the same structure.
+func openAPIContent(schema map[string]any) map[string]any {
+	ret := openAPIJSONContent(schema)
+	for _, mime := range []string{mimeMsgpack, mimeCBOR} {
+		ret[mime] = map[string]any{"schema": schema}
+	}
+	return ret
+}
+
+func openAPIJSONContent(schema map[string]any) map[string]any {
+	return map[string]any{fiber.MIMEApplicationJSON: map[string]any{"schema": schema}}
+}
+
+// Either of some schemas
+func oneOf(schemas ...map[string]any) map[string]any {
+	return map[string]any{"oneOf": schemas}
+}
+
+// Describes an operation. The content of the body is optional (nil if there's
+// none); the response is the one of a success.
+func openAPIOperation(id, summary string, body map[string]any, required bool, respDesc string, resp map[string]any) map[string]any {
+	ret := map[string]any{
+		"operationId": id,
+		"summary":     summary,
+		"responses": map[string]any{
+			"200":     map[string]any{"description": respDesc, "content": resp},
+			"default": map[string]any{"description": "An error; reqIdx is the index of the failed item, or -1", "content": openAPIContent(schemaRef("error"))},
+		},
+	}
+	if body != nil {
+		ret["requestBody"] = map[string]any{"required": required, "content": body}
+	}
+	return ret
+}
+
+func openAPIPathParams(names ...string) []map[string]any {
+	ret := []map[string]any{}
+	for _, name := range names {
+		ret = append(ret, map[string]any{
+			"name":     name,
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]any{"type": "string"},
+		})
+	}
+	return ret
+}
+
+// The description of a database, as a set of paths
+func openAPIPaths(db *db, paths map[string]any) {
+	dbPath := "/" + url.PathEscape(db.Id)
+
+	var notes []string
+	if db.ReadOnly {
+		notes = append(notes, "The database is read only.")
+	}
+	if db.UseOnlyStoredStatements {
+		notes = append(notes, "Only stored statements can be used.")
+	}
+	// For the POST endpoints, the credentials are passed in the request with
+	// INLINE authentication; for the others, always as HTTP Basic Authentication
+	var security []map[string][]string
+	var getSecurity []map[string][]string
+	if db.Auth != nil {
+		getSecurity = []map[string][]string{{"basicAuth": {}}}
+		if strings.ToUpper(db.Auth.Mode) == authModeHttp {
+			security = getSecurity
+			notes = append(notes, "Authentication is via HTTP Basic Authentication.")
+		} else {
+			notes = append(notes, "Authentication is via the credentials field of the request.")
+		}
+	}
+
+	// Adds an operation to a path, with the security and the notes
+	addOp := func(path, method string, op map[string]any, params []map[string]any, secure []map[string][]string) {
+		if len(notes) > 0 {
+			op["description"] = strings.Join(notes, " ")
+		}
+		if secure != nil {
+			op["security"] = secure
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		item, ok := paths[dbPath+path].(map[string]any)
+		if !ok {
+			item = make(map[string]any)
+			paths[dbPath+path] = item
+		}
+		item[method] = op
+	}
+
+	stmts := []map[string]any{}
+	for _, ss := range db.StoredStatement {
+		params := namedParams(ss.Sql)
+		stmts = append(stmts, map[string]any{"id": ss.Id, "parameters": params, "allowGet": ss.AllowGet})
+
+		if !ss.AllowGet {
+			continue
+		}
+		queryParams := []map[string]any{}
+		for _, param := range params {
+			queryParams = append(queryParams, map[string]any{
+				"name":     param,
+				"in":       "query",
+				"required": true,
+				"schema":   map[string]any{"type": "string"},
+			})
+		}
+		op := openAPIOperation(fmt.Sprintf("%s_%s", db.Id, ss.Id),
+			fmt.Sprintf("Executes the stored statement '%s' on the database '%s'", ss.Id, db.Id),
+			nil, false, "The result of the statement", openAPIContent(schemaRef("response")))
+		addOp("/"+url.PathEscape(ss.Id), "get", op, queryParams, getSecurity)
+	}
+
+	// With version 2 of the protocol, the response is a responseV2, also for
+	// the errors; the resultFormat can make it CSV or NDJSON.
+	resp := openAPIContent(oneOf(schemaRef("response"), schemaRef("responseV2")))
+	resp["text/csv"] = map[string]any{"schema": map[string]any{"type": "string"}}
+	resp["application/x-ndjson"] = map[string]any{"schema": map[string]any{"type": "string"}}
+	op := openAPIOperation(db.Id, fmt.Sprintf("Executes a transaction on the database '%s'", db.Id),
+		openAPIContent(schemaRef("request")), true, "The results of the items of the transaction", resp)
+	op["responses"].(map[string]any)["default"] = map[string]any{
+		"description": "An error; reqIdx is the index of the failed item, or -1",
+		"content":     openAPIContent(oneOf(schemaRef("error"), schemaRef("responseV2"))),
+	}
+	// The stored statements, to be referenced in a query or statement with "#<id>"
+	op["x-storedStatements"] = stmts
+	addOp("", "post", op, nil, security)
+
+	// A query with pageSize opens a cursor, that is read with these
+	addOp("/cursor/{cursorId}", "post", openAPIOperation(db.Id+"_cursorPage",
+		fmt.Sprintf("Reads the next page of a cursor on the database '%s'", db.Id),
+		openAPIContent(schemaRef("request")), false, "The page, as the result of the query", openAPIContent(schemaRef("response"))),
+		openAPIPathParams("cursorId"), security)
+	addOp("/cursor/{cursorId}/close", "post", openAPIOperation(db.Id+"_cursorClose",
+		fmt.Sprintf("Closes a cursor on the database '%s'", db.Id),
+		openAPIContent(schemaRef("request")), false, "The cursor was closed", openAPIContent(schemaRef("cursorResponse"))),
+		openAPIPathParams("cursorId"), security)
+
+	if db.InteractiveTx {
+		addOp("/tx", "post", openAPIOperation(db.Id+"_txBegin",
+			fmt.Sprintf("Opens an interactive transaction on the database '%s'", db.Id),
+			openAPIContent(schemaRef("request")), false, "The ID of the transaction", openAPIContent(schemaRef("txResponse"))),
+			nil, security)
+		addOp("/tx/{txId}", "post", openAPIOperation(db.Id+"_txBatch",
+			fmt.Sprintf("Executes a batch of items in an interactive transaction on the database '%s'", db.Id),
+			openAPIContent(schemaRef("request")), true, "The results of the items of the batch", openAPIContent(schemaRef("response"))),
+			openAPIPathParams("txId"), security)
+		for _, end := range []string{"commit", "rollback"} {
+			addOp("/tx/{txId}/"+end, "post", openAPIOperation(db.Id+"_tx_"+end,
+				fmt.Sprintf("Ends (%s) an interactive transaction on the database '%s'", end, db.Id),
+				openAPIContent(schemaRef("request")), false, "The transaction was ended", openAPIContent(schemaRef("txResponse"))),
+				openAPIPathParams("txId"), security)
+		}
+	}
+
+	if db.WebSocket {
+		op := openAPIOperation(db.Id+"_ws", fmt.Sprintf("Opens a WebSocket session on the database '%s'", db.Id),
+			nil, false, "", nil)
+		responses := op["responses"].(map[string]any)
+		responses["101"] = map[string]any{"description": "The connection is upgraded to a WebSocket"}
+		delete(responses, "200")
+		addOp("/ws", "get", op, nil, security)
+	}
+
+	if db.EnableChangeFeed {
+		addOp("/events", "get", openAPIOperation(db.Id+"_events",
+			fmt.Sprintf("Subscribes to the changes of the database '%s', as Server-Sent Events", db.Id),
+			nil, false, "A stream of events, each with a changeEvent as data",
+			map[string]any{"text/event-stream": map[string]any{"schema": map[string]any{"type": "string"}}}),
+			[]map[string]any{
+				{"name": "lastEventId", "in": "query", "required": false, "schema": map[string]any{"type": "integer"}},
+				{"name": "tables", "in": "query", "required": false, "schema": map[string]any{"type": "string"}, "description": "Comma-separated list of the tables to follow"},
+			},
+			getSecurity)
+	}
+
+	if db.TableRoutes {
+		row := map[string]any{"type": "object", "description": "The values of the columns"}
+		tableResp := openAPIContent(schemaRef("response"))
+		addOp("/tables/{table}", "get", openAPIOperation(db.Id+"_tableList",
+			fmt.Sprintf("Lists the rows of a table of the database '%s'; the other query parameters filter on the columns", db.Id),
+			nil, false, "The rows", tableResp),
+			append(openAPIPathParams("table"),
+				map[string]any{"name": tableParamOrderBy, "in": "query", "required": false, "schema": map[string]any{"type": "string"}},
+				map[string]any{"name": tableParamLimit, "in": "query", "required": false, "schema": map[string]any{"type": "integer"}},
+				map[string]any{"name": tableParamOffset, "in": "query", "required": false, "schema": map[string]any{"type": "integer"}}),
+			getSecurity)
+		insert := openAPIOperation(db.Id+"_tableInsert",
+			fmt.Sprintf("Inserts a row in a table of the database '%s'", db.Id),
+			openAPIJSONContent(row), false, "The inserted row", tableResp)
+		responses := insert["responses"].(map[string]any)
+		responses["201"] = responses["200"]
+		delete(responses, "200")
+		addOp("/tables/{table}", "post", insert, openAPIPathParams("table"), getSecurity)
+		addOp("/tables/{table}/{pk}", "get", openAPIOperation(db.Id+"_tableGet",
+			fmt.Sprintf("Reads a row of a table of the database '%s', by primary key", db.Id),
+			nil, false, "The row", tableResp),
+			openAPIPathParams("table", "pk"), getSecurity)
+		addOp("/tables/{table}/{pk}", "patch", openAPIOperation(db.Id+"_tableUpdate",
+			fmt.Sprintf("Updates a row of a table of the database '%s', by primary key", db.Id),
+			openAPIJSONContent(row), true, "The updated row", tableResp),
+			openAPIPathParams("table", "pk"), getSecurity)
+		addOp("/tables/{table}/{pk}", "delete", openAPIOperation(db.Id+"_tableDelete",
+			fmt.Sprintf("Deletes a row of a table of the database '%s', by primary key", db.Id),
+			nil, false, "The deleted row", tableResp),
+			openAPIPathParams("table", "pk"), getSecurity)
+	}
+
+	if db.SchemaRoute {
+		addOp("/schema", "get", openAPIOperation(db.Id+"_schema",
+			fmt.Sprintf("Describes the schema of the database '%s'", db.Id),
+			nil, false, "The schema", openAPIContent(schemaRef("schemaResponse"))),
+			nil, getSecurity)
+	}
+}
+
+func genOpenAPI(dbs map[string]db) ([]byte, error) {
+	schemas := make(map[string]any)
+	for t, name := range openAPISchemas {
+		schemas[name] = schemaOf(t, true)
+	}
+
+	paths := make(map[string]any)
+	for id := range dbs {
+		db := dbs[id]
+		openAPIPaths(&db, paths)
+	}
+
+	return json.Marshal(map[string]any{
+		"openapi": "3.0.3",
+		"info":    map[string]any{"title": "ws4sqlite", "version": version},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas":         schemas,
+			"securitySchemes": map[string]any{"basicAuth": map[string]any{"type": "http", "scheme": "basic"}},
+		},
+	})
+}
+
+func openAPIHandler(doc []byte) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Send(doc)
+	}
+}
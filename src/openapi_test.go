@@ -0,0 +1,198 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNamedParams(t *testing.T) {
+	params := namedParams("SELECT ':no', \"@no\", [$no] FROM T -- :no\n WHERE A = :a AND B = @b /* :no */ AND C = $c AND D = :a AND E = ?")
+	if !slices.Equal(params, []string{"a", "b", "c"}) {
+		t.Error("wrong params:", params)
+	}
+}
+
+func TestOpenAPISetup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		OpenAPI:  true,
+		Databases: []db{
+			{
+				Id:   "oa",
+				Path: ":memory:",
+				Auth: &authr{
+					Mode:          "HTTP",
+					ByCredentials: []credentialsCfg{{User: "pietro", Password: "hey"}},
+				},
+				StoredStatement: []storedStatement{
+					{Id: "byId", Sql: "SELECT * FROM T WHERE ID = :id", AllowGet: true},
+					{Id: "all", Sql: "SELECT * FROM T"},
+				},
+			},
+			{
+				Id:            "oapub",
+				Path:          ":memory:",
+				InteractiveTx: true,
+				TableRoutes:   true,
+				SchemaRoute:   true,
+				StoredStatement: []storedStatement{
+					{Id: "byId", Sql: "SELECT * FROM T WHERE ID = :id", AllowGet: true},
+					{Id: "all", Sql: "SELECT * FROM T"},
+				},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestOpenAPI(t *testing.T) {
+	resp, err := http.Get("http://localhost:12321/openapi.json")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]struct {
+			Get *struct {
+				Parameters []struct {
+					Name string `json:"name"`
+				} `json:"parameters"`
+			} `json:"get"`
+			Post *struct {
+				Security []map[string][]string `json:"security"`
+				Stmts    []struct {
+					Id         string   `json:"id"`
+					Parameters []string `json:"parameters"`
+				} `json:"x-storedStatements"`
+				Responses map[string]struct {
+					Content map[string]struct {
+						Schema struct {
+							OneOf []map[string]string `json:"oneOf"`
+						} `json:"schema"`
+					} `json:"content"`
+				} `json:"responses"`
+			} `json:"post"`
+			Patch *struct {
+				Parameters []struct {
+					Name string `json:"name"`
+				} `json:"parameters"`
+			} `json:"patch"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]any `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if resp.StatusCode != 200 || doc.OpenAPI == "" {
+		t.Error("wrong response")
+		return
+	}
+
+	post := doc.Paths["/oa"].Post
+	if post == nil || len(post.Security) != 1 || len(post.Stmts) != 2 || !slices.Equal(post.Stmts[0].Parameters, []string{"id"}) {
+		t.Error("wrong description of the POST endpoint")
+		return
+	}
+
+	get := doc.Paths["/oa/byId"].Get
+	if get == nil || len(get.Parameters) != 1 || get.Parameters[0].Name != "id" {
+		t.Error("wrong description of the GET endpoint")
+		return
+	}
+
+	post = doc.Paths["/oapub"].Post
+	if post == nil || len(post.Security) != 0 || len(post.Stmts) != 2 || !slices.Equal(post.Stmts[0].Parameters, []string{"id"}) {
+		t.Error("wrong description of the POST endpoint")
+		return
+	}
+
+	get = doc.Paths["/oapub/byId"].Get
+	if get == nil || len(get.Parameters) != 1 || get.Parameters[0].Name != "id" {
+		t.Error("wrong description of the GET endpoint")
+		return
+	}
+
+	if _, found := doc.Paths["/oapub/all"]; found {
+		t.Error("a statement without allowGet is described as a GET endpoint")
+		return
+	}
+
+	for _, path := range []string{"/oapub/tx", "/oapub/tx/{txId}/commit", "/oapub/cursor/{cursorId}", "/oapub/schema", "/oapub/tables/{table}"} {
+		if _, found := doc.Paths[path]; !found {
+			t.Error("missing path:", path)
+			return
+		}
+	}
+	if _, found := doc.Paths["/oa/tx"]; found {
+		t.Error("a route that is not enabled is described")
+		return
+	}
+
+	patch := doc.Paths["/oapub/tables/{table}/{pk}"].Patch
+	if patch == nil || len(patch.Parameters) != 2 || patch.Parameters[1].Name != "pk" {
+		t.Error("wrong description of the table routes")
+		return
+	}
+
+	if _, found := doc.Components.Schemas["requestItem"].Properties["valuesBatch"]; !found {
+		t.Error("wrong schema of requestItem")
+		return
+	}
+
+	// Version 2 of the protocol, and the other encodings
+	content := post.Responses["200"].Content
+	if len(content["application/json"].Schema.OneOf) != 2 || len(content[mimeMsgpack].Schema.OneOf) != 2 || len(content[mimeCBOR].Schema.OneOf) != 2 {
+		t.Error("wrong responses of the POST endpoint")
+		return
+	}
+	if oneOf := post.Responses["default"].Content["application/json"].Schema.OneOf; len(oneOf) != 2 || oneOf[1]["$ref"] != "#/components/schemas/responseV2" {
+		t.Error("wrong error response of the POST endpoint")
+		return
+	}
+
+	itemV2 := doc.Components.Schemas["responseItemV2"].Properties
+	errV2, _ := itemV2["error"].(map[string]any)
+	if _, found := itemV2["resultSet"]; !found || errV2["$ref"] != "#/components/schemas/errorV2" {
+		t.Error("wrong schema of responseItemV2")
+		return
+	}
+	if _, found := doc.Components.Schemas["responseV2"].Properties["meta"]; !found {
+		t.Error("wrong schema of responseV2")
+	}
+}
+
+func TestOpenAPITeardown(t *testing.T) {
+	time.Sleep(time.Second)
+	Shutdown()
+}
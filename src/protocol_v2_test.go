@@ -0,0 +1,138 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func callV2(databaseId string, req request, t *testing.T) (int, responseV2) {
+	req.Version = protocolV2
+	code, body := callRawBA(databaseId, req, "", "", t)
+
+	var ret responseV2
+	if err := json.Unmarshal(body, &ret); err != nil {
+		t.Error(err, string(body))
+	}
+	return code, ret
+}
+
+func TestV2Setup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:   "v2",
+				Path: ":memory:",
+				InitStatements: []string{
+					"CREATE TABLE T (ID INT PRIMARY KEY, VAL TEXT)",
+					"INSERT INTO T VALUES (1, 'ONE')",
+				},
+			},
+			{
+				Id:   "v2auth",
+				Path: ":memory:",
+				Auth: &authr{
+					Mode:          "INLINE",
+					ByCredentials: []credentialsCfg{{User: "pietro", Password: "hey"}},
+				},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestV2(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			{Query: "SELECT VAL FROM T WHERE ID = 1"},
+			{Statement: "INSERT INTO T VALUES (1, 'DUP')", NoFail: true},
+			{Statement: "INSERT INTO T VALUES (2, 'TWO')"},
+		},
+	}
+	code, res := callV2("v2", req, t)
+	if code != 200 || res.Version != 2 || !res.Success || res.Error != nil || len(res.Results) != 3 {
+		t.Error("wrong result")
+		return
+	}
+
+	if res.Meta.DbId != "v2" || res.Meta.ServerVersion == "" || res.Meta.DryRun {
+		t.Error("wrong metadata")
+		return
+	}
+
+	if getDefault[string](res.Results[0].ResultSet[0], "VAL") != "ONE" || *res.Results[2].RowsUpdated != 1 {
+		t.Error("wrong results of the items")
+		return
+	}
+
+	item := res.Results[1]
+	if item.Success || item.Error == nil || item.Error.Type != "EXECUTION_ERROR" || item.Error.Message == "" || *item.Error.RequestIdx != 1 {
+		t.Error("wrong error of a noFail item")
+	}
+}
+
+func TestV2Errors(t *testing.T) {
+	code, res := callV2("v2", request{Transaction: []requestItem{
+		{Query: "SELECT 1"},
+		{Precondition: "SELECT 0"},
+	}}, t)
+	if code != 412 || res.Success || res.Error == nil || res.Error.Type != "PRECONDITION_FAILED" || *res.Error.RequestIdx != 1 || res.Results != nil {
+		t.Error("wrong failure of the transaction")
+		return
+	}
+
+	code, res = callV2("v2", request{}, t)
+	if code != 400 || res.Error == nil || res.Error.Type != "BAD_REQUEST" || res.Error.RequestIdx != nil {
+		t.Error("wrong failure of the request")
+		return
+	}
+
+	code, res = callV2("v2auth", request{Transaction: []requestItem{{Query: "SELECT 1"}}}, t)
+	if code != 401 || res.Error == nil || res.Error.Type != "UNAUTHORIZED" {
+		t.Error("wrong failure of the authentication")
+		return
+	}
+
+	code, _ = callRawBA("v2", request{Version: 3, Transaction: []requestItem{{Query: "SELECT 1"}}}, "", "", t)
+	if code != 400 {
+		t.Error("accepted an unsupported version")
+	}
+}
+
+func TestV1Unchanged(t *testing.T) {
+	code, body, res := call("v2", request{Version: 1, Transaction: []requestItem{{Query: "SELECT 1 AS ONE"}}}, t)
+	if code != 200 || getDefault[float64](res.Results[0].ResultSet[0], "ONE") != 1 {
+		t.Error("wrong result")
+		return
+	}
+
+	var raw map[string]any
+	if err := json.Unmarshal([]byte(body), &raw); err != nil || len(raw) != 1 {
+		t.Error("the response is not in version 1:", body)
+	}
+}
+
+func TestV2Teardown(t *testing.T) {
+	time.Sleep(time.Second)
+	Shutdown()
+}
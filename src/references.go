@@ -0,0 +1,208 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iancoleman/orderedmap"
+)
+
+const refTag = "$ref"
+
+// A value can be a reference to the result of an item that comes before it
+// in the same transaction, e.g. {"$ref": "0.rowsUpdated"} or
+// {"$ref": "2.resultSet[0].id"}. The first component is the index of the item,
+// the rest is a path in its JSON response, made of field names and indexes.
+//
+// The references are replaced in-place with the values they point to. These
+// must be scalars; a BLOB is bound as such, whatever its format in the
+// response.
+func resolveRefs(params *requestParams, results []responseItem) error {
+	var err error
+	for key, val := range params.UnmarshalledDict {
+		if params.UnmarshalledDict[key], err = resolveRef(val, results); err != nil {
+			return err
+		}
+	}
+	for i, val := range params.UnmarshalledArray {
+		if params.UnmarshalledArray[i], err = resolveRef(val, results); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolveRef(val any, results []responseItem) (any, error) {
+	obj, ok := val.(map[string]interface{})
+	if !ok || len(obj) != 1 {
+		return val, nil
+	}
+	refVal, ok := obj[refTag]
+	if !ok {
+		return val, nil
+	}
+	ref, ok := refVal.(string)
+	if !ok {
+		return nil, fmt.Errorf("the value of a %s must be a string", refTag)
+	}
+
+	idxStr, path, _ := strings.Cut(ref, ".")
+	idx, err := strconv.Atoi(idxStr)
+	if err != nil || idx < 0 {
+		return nil, fmt.Errorf("invalid reference '%s': it must start with the index of an item", ref)
+	}
+	if idx >= len(results) {
+		return nil, fmt.Errorf("invalid reference '%s': item #%d doesn't come before this one", ref, idx)
+	}
+	if !results[idx].Success {
+		return nil, fmt.Errorf("invalid reference '%s': item #%d failed", ref, idx)
+	}
+
+	tokens, err := parseRefPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reference '%s': %s", ref, err.Error())
+	}
+
+	// Navigates the response following the names of its JSON fields, so that
+	// the paths are the same that the client sees
+	cur := reflect.ValueOf(results[idx])
+	for _, token := range tokens {
+		if cur, err = refChild(cur, token); err != nil {
+			return nil, fmt.Errorf("invalid reference '%s': %s", ref, err.Error())
+		}
+	}
+
+	for cur.Kind() == reflect.Pointer || cur.Kind() == reflect.Interface {
+		if cur.IsNil() {
+			return nil, nil
+		}
+		cur = cur.Elem()
+	}
+
+	// BLOBs are bound as such, whatever their format in the response
+	switch v := cur.Interface().(type) {
+	case []byte:
+		return v, nil
+	case hexBlob:
+		return hex.DecodeString(string(v))
+	case map[string]string:
+		if b64, ok := v[blobTag]; ok && len(v) == 1 {
+			return base64.StdEncoding.DecodeString(b64)
+		}
+	case time.Time:
+		return v, nil
+	}
+
+	switch cur.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cur.Int(), nil
+	case reflect.Float32, reflect.Float64:
+		return cur.Float(), nil
+	case reflect.String:
+		return cur.String(), nil
+	case reflect.Bool:
+		return cur.Bool(), nil
+	default:
+		return nil, fmt.Errorf("invalid reference '%s': it doesn't point to a single value", ref)
+	}
+}
+
+// Returns the field, element or entry of a value that a component of a path
+// points to. A field that would be omitted in the JSON is not found.
+func refChild(v reflect.Value, token string) (reflect.Value, error) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return v, fmt.Errorf("cannot navigate into '%s'", token)
+		}
+		v = v.Elem()
+	}
+
+	if om, ok := v.Interface().(orderedmap.OrderedMap); ok {
+		if item, found := om.Get(token); found {
+			return reflect.ValueOf(&item).Elem(), nil
+		}
+		return v, fmt.Errorf("'%s' not found", token)
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name, opts, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			if name != token || !t.Field(i).IsExported() {
+				continue
+			}
+			field := v.Field(i)
+			if (opts == "omitempty" && field.IsZero()) || (opts == "omitnil" && field.IsNil()) {
+				break
+			}
+			return field, nil
+		}
+		return v, fmt.Errorf("'%s' not found", token)
+	case reflect.Slice, reflect.Array:
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i >= v.Len() {
+			return v, fmt.Errorf("index '%s' out of bounds", token)
+		}
+		return v.Index(i), nil
+	case reflect.Map:
+		if item := v.MapIndex(reflect.ValueOf(token)); item.IsValid() {
+			return item, nil
+		}
+		return v, fmt.Errorf("'%s' not found", token)
+	default:
+		return v, fmt.Errorf("cannot navigate into '%s'", token)
+	}
+}
+
+// Splits a path like "resultSet[0].id" into its components: "resultSet", "0", "id"
+func parseRefPath(path string) ([]string, error) {
+	var tokens []string
+	if path == "" {
+		return nil, fmt.Errorf("missing path after the index")
+	}
+	for _, segment := range strings.Split(path, ".") {
+		name, rest, hasIdx := strings.Cut(segment, "[")
+		if name != "" {
+			tokens = append(tokens, name)
+		} else if !hasIdx {
+			return nil, fmt.Errorf("empty component in path")
+		}
+		for hasIdx {
+			var idx string
+			if idx, rest, hasIdx = strings.Cut(rest, "]"); !hasIdx {
+				return nil, fmt.Errorf("unclosed '['")
+			}
+			tokens = append(tokens, idx)
+			if rest == "" {
+				break
+			}
+			if !strings.HasPrefix(rest, "[") {
+				return nil, fmt.Errorf("unexpected '%s' after ']'", rest)
+			}
+			rest = rest[1:]
+		}
+	}
+	return tokens, nil
+}
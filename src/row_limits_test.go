@@ -0,0 +1,145 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const fiveRowsQuery = "WITH RECURSIVE C(X) AS (SELECT 1 UNION ALL SELECT X + 1 FROM C WHERE X < 5) SELECT X FROM C"
+
+func TestRowLimitsSetup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:      "maxrows",
+				Path:    ":memory:",
+				MaxRows: 3,
+			},
+			{
+				Id:            "failmaxrows",
+				Path:          ":memory:",
+				MaxRows:       3,
+				FailOnMaxRows: true,
+			},
+			{
+				Id:   "nomaxrows",
+				Path: ":memory:",
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestRowLimitsTruncate(t *testing.T) {
+	code, _, res := call("maxrows", request{Transaction: []requestItem{{Query: fiveRowsQuery}}}, t)
+	if code != 200 || len(res.Results[0].ResultSet) != 3 || !res.Results[0].Truncated {
+		t.Error("the result set was not truncated")
+		return
+	}
+
+	// Exactly the maximum number of rows, not truncated
+	code, _, res = call("maxrows", request{Transaction: []requestItem{{Query: fiveRowsQuery + " LIMIT 3"}}}, t)
+	if code != 200 || len(res.Results[0].ResultSet) != 3 || res.Results[0].Truncated {
+		t.Error("the result set was truncated")
+		return
+	}
+
+	resultFormat := resultFormatList
+	code, _, res = call("maxrows", request{ResultFormat: &resultFormat, Transaction: []requestItem{{Query: fiveRowsQuery}}}, t)
+	if code != 200 || len(res.Results[0].ResultSetList) != 3 || !res.Results[0].Truncated {
+		t.Error("the list result set was not truncated")
+	}
+}
+
+func TestRowLimitsItem(t *testing.T) {
+	code, _, res := call("nomaxrows", request{Transaction: []requestItem{{Query: fiveRowsQuery, Limit: 2}}}, t)
+	if code != 200 || len(res.Results[0].ResultSet) != 2 || !res.Results[0].Truncated {
+		t.Error("the result set was not truncated to the item limit")
+		return
+	}
+
+	code, _, res = call("nomaxrows", request{Transaction: []requestItem{{Query: fiveRowsQuery}}}, t)
+	if code != 200 || len(res.Results[0].ResultSet) != 5 || res.Results[0].Truncated {
+		t.Error("the result set was truncated without limits")
+		return
+	}
+
+	// The item cannot raise the limit of the database
+	code, _, res = call("maxrows", request{Transaction: []requestItem{{Query: fiveRowsQuery, Limit: 10}}}, t)
+	if code != 200 || len(res.Results[0].ResultSet) != 3 || !res.Results[0].Truncated {
+		t.Error("the item raised the limit of the database")
+		return
+	}
+
+	// A lower limit of the item doesn't make the request fail
+	code, _, res = call("failmaxrows", request{Transaction: []requestItem{{Query: fiveRowsQuery, Limit: 2}}}, t)
+	if code != 200 || len(res.Results[0].ResultSet) != 2 || !res.Results[0].Truncated {
+		t.Error("the result set was not truncated to the item limit")
+	}
+}
+
+func TestRowLimitsFail(t *testing.T) {
+	code, _, _ := call("failmaxrows", request{Transaction: []requestItem{{Query: fiveRowsQuery}}}, t)
+	if code != 400 {
+		t.Error("the request did not fail")
+		return
+	}
+
+	code, _, res := call("failmaxrows", request{Transaction: []requestItem{{Query: fiveRowsQuery, NoFail: true}}}, t)
+	if code != 200 || res.Results[0].Success {
+		t.Error("the item did not fail")
+		return
+	}
+
+	code, _, res = call("failmaxrows", request{Transaction: []requestItem{{Query: fiveRowsQuery + " LIMIT 3"}}}, t)
+	if code != 200 || len(res.Results[0].ResultSet) != 3 {
+		t.Error("the request failed without exceeding the limit")
+	}
+}
+
+func TestRowLimitsCSV(t *testing.T) {
+	// A truncated CSV would look complete
+	resultFormat := resultFormatCSV
+	code, _ := callRawBA("maxrows", request{ResultFormat: &resultFormat, Transaction: []requestItem{{Query: fiveRowsQuery}}}, "", "", t)
+	if code != 400 {
+		t.Error("a truncated csv was returned", code)
+		return
+	}
+
+	code, body := callRawBA("maxrows", request{ResultFormat: &resultFormat, Transaction: []requestItem{{Query: fiveRowsQuery, Limit: 2}}}, "", "", t)
+	if code != 200 || string(body) != "X\r\n1\r\n2\r\n" {
+		t.Error("the csv was not limited by the item", code, string(body))
+	}
+}
+
+func TestRowLimitsKO(t *testing.T) {
+	code, _, _ := call("nomaxrows", request{Transaction: []requestItem{{Query: "SELECT 1", Limit: -1}}}, t)
+	if code != 400 {
+		t.Error("a negative limit should not be accepted")
+	}
+}
+
+func TestRowLimitsTeardown(t *testing.T) {
+	time.Sleep(time.Second)
+	Shutdown()
+}
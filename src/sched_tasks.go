@@ -118,6 +118,10 @@ func doTask(task scheduledTask) func() {
 					mllog.Errorf("sched. task (statement #%d): %s", idx, err.Error())
 				}
 			}
+
+			if task.Db.ChangeFeed != nil {
+				publishAutocommitChanges(task.Db)
+			}
 		}
 	}
 }
@@ -0,0 +1,230 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// With schemaRoute, GET /<dbId>/schema describes the tables, views and
+// triggers of the main schema of the database, reading them from the
+// sqlite_schema table and the pragmas. The internal objects of SQLite, and
+// those of ws4sqlite, are not listed.
+
+func readColumns(ctx context.Context, tx *sql.Tx, table string) ([]schemaColumn, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT name, type, \"notnull\", dflt_value, pk FROM pragma_table_info(?, 'main') ORDER BY cid", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := []schemaColumn{}
+	for rows.Next() {
+		var col schemaColumn
+		var notNull bool
+		var dflt sql.NullString
+		if err := rows.Scan(&col.Name, &col.Type, &notNull, &dflt, &col.PK); err != nil {
+			return nil, err
+		}
+		col.Nullable = !notNull
+		if dflt.Valid {
+			col.Default = &dflt.String
+		}
+		ret = append(ret, col)
+	}
+	return ret, rows.Err()
+}
+
+func readIndexes(ctx context.Context, tx *sql.Tx, table string) ([]schemaIndex, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT name, \"unique\", origin, partial FROM pragma_index_list(?, 'main') ORDER BY name", table)
+	if err != nil {
+		return nil, err
+	}
+	ret := []schemaIndex{}
+	for rows.Next() {
+		var idx schemaIndex
+		if err := rows.Scan(&idx.Name, &idx.Unique, &idx.Origin, &idx.Partial); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ret = append(ret, idx)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range ret {
+		// A column is NULL when it's an expression
+		rows, err := tx.QueryContext(ctx, "SELECT IFNULL(name, '<expr>') FROM pragma_index_info(?, 'main') ORDER BY seqno", ret[i].Name)
+		if err != nil {
+			return nil, err
+		}
+		ret[i].Columns = []string{}
+		for rows.Next() {
+			var col string
+			if err := rows.Scan(&col); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			ret[i].Columns = append(ret[i].Columns, col)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func readForeignKeys(ctx context.Context, tx *sql.Tx, table string) ([]schemaForeignKey, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id, \"from\", \"table\", IFNULL(\"to\", ''), on_update, on_delete FROM pragma_foreign_key_list(?, 'main') ORDER BY id, seq", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := []schemaForeignKey{}
+	lastId := -1
+	for rows.Next() {
+		var id int
+		var from, to string
+		var fk schemaForeignKey
+		if err := rows.Scan(&id, &from, &fk.Table, &to, &fk.OnUpdate, &fk.OnDelete); err != nil {
+			return nil, err
+		}
+		// A foreign key on more columns has a row per column, with the same id
+		if id != lastId {
+			ret = append(ret, fk)
+			lastId = id
+		}
+		last := &ret[len(ret)-1]
+		last.Columns = append(last.Columns, from)
+		last.ToColumns = append(last.ToColumns, to) // "" means the primary key of the referenced table
+	}
+	return ret, rows.Err()
+}
+
+func readSchema(ctx context.Context, tx *sql.Tx) (*schemaResponse, error) {
+	ret := schemaResponse{Tables: []schemaTable{}, Views: []schemaView{}, Triggers: []schemaTrigger{}}
+
+	rows, err := tx.QueryContext(ctx, "SELECT name, type, wr, strict FROM pragma_table_list WHERE schema = 'main' AND type IN ('table', 'view') AND name NOT LIKE 'sqlite\\_%' ESCAPE '\\' AND name NOT LIKE '\\_ws4sqlite\\_%' ESCAPE '\\' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	var tables []schemaTable
+	var viewNames []string
+	for rows.Next() {
+		var name, typ string
+		var wr, strict bool
+		if err := rows.Scan(&name, &typ, &wr, &strict); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if typ == "view" {
+			viewNames = append(viewNames, name)
+		} else {
+			tables = append(tables, schemaTable{Name: name, WithoutRowid: wr, Strict: strict})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, table := range tables {
+		if table.Columns, err = readColumns(ctx, tx, table.Name); err != nil {
+			return nil, err
+		}
+		if table.Indexes, err = readIndexes(ctx, tx, table.Name); err != nil {
+			return nil, err
+		}
+		if table.ForeignKeys, err = readForeignKeys(ctx, tx, table.Name); err != nil {
+			return nil, err
+		}
+		ret.Tables = append(ret.Tables, table)
+	}
+
+	for _, name := range viewNames {
+		view := schemaView{Name: name}
+		if view.Columns, err = readColumns(ctx, tx, name); err != nil {
+			return nil, err
+		}
+		if err := tx.QueryRowContext(ctx, "SELECT sql FROM main.sqlite_schema WHERE type = 'view' AND name = ?", name).Scan(&view.Sql); err != nil {
+			return nil, err
+		}
+		ret.Views = append(ret.Views, view)
+	}
+
+	rows, err = tx.QueryContext(ctx, "SELECT name, tbl_name, sql FROM main.sqlite_schema WHERE type = 'trigger' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var trigger schemaTrigger
+		if err := rows.Scan(&trigger.Name, &trigger.Table, &trigger.Sql); err != nil {
+			return nil, err
+		}
+		ret.Triggers = append(ret.Triggers, trigger)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &ret, nil
+}
+
+// Handler for GET /<dbId>/schema
+func schemaHandler(databaseId string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		db, err := lookupDb(databaseId)
+		if err != nil {
+			return err
+		}
+
+		// Execute non-concurrently
+		if err := lockDb(&db); err != nil {
+			return err
+		}
+		defer db.Mutex.Unlock()
+
+		if err := ckInlineAuthHeader(&db, c); err != nil {
+			return err
+		}
+
+		ctx, cancel := newRequestContext(&db)
+		defer cancel()
+
+		// In a transaction, to read a consistent snapshot
+		tx, err := db.DbConn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: true})
+		if err != nil {
+			return newWSError(-1, fiber.StatusInternalServerError, err.Error())
+		}
+		defer tx.Rollback()
+
+		ret, err := readSchema(ctx, tx)
+		if err != nil {
+			return newWSError(-1, fiber.StatusInternalServerError, err.Error())
+		}
+
+		return sendResponse(c, 200, ret)
+	}
+}
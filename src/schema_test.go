@@ -0,0 +1,155 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func callSchema(dbId, user, password string, t *testing.T) (int, schemaResponse) {
+	req, err := http.NewRequest("GET", "http://localhost:12321/"+dbId+"/schema", nil)
+	if err != nil {
+		t.Error(err)
+		return -1, schemaResponse{}
+	}
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return -1, schemaResponse{}
+	}
+	defer resp.Body.Close()
+
+	var ret schemaResponse
+	if resp.StatusCode == 200 {
+		if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+			t.Error(err)
+		}
+	}
+	return resp.StatusCode, ret
+}
+
+func TestSchemaSetup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:          "schema",
+				Path:        ":memory:",
+				SchemaRoute: true,
+				InitStatements: []string{
+					"CREATE TABLE P (ID INTEGER PRIMARY KEY, NAME TEXT NOT NULL DEFAULT 'x')",
+					"CREATE TABLE C (ID INT, P_ID INT REFERENCES P(ID) ON DELETE CASCADE, VAL TEXT UNIQUE, PRIMARY KEY (ID, P_ID)) WITHOUT ROWID",
+					"CREATE INDEX C_VAL ON C (VAL, P_ID)",
+					"CREATE VIEW V AS SELECT NAME FROM P",
+					"CREATE TRIGGER TR AFTER INSERT ON P BEGIN SELECT 1; END",
+				},
+			},
+			{
+				Id:                      "schemainline",
+				Path:                    ":memory:",
+				SchemaRoute:             true,
+				UseOnlyStoredStatements: true,
+				Auth: &authr{
+					Mode:          "INLINE",
+					ByCredentials: []credentialsCfg{{User: "pietro", Password: "hey"}},
+				},
+				StoredStatement: []storedStatement{{Id: "Q", Sql: "SELECT 1"}},
+			},
+			{
+				Id:   "noschema",
+				Path: ":memory:",
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestSchema(t *testing.T) {
+	code, res := callSchema("schema", "", "", t)
+	if code != 200 || len(res.Tables) != 2 || len(res.Views) != 1 || len(res.Triggers) != 1 {
+		t.Error("wrong result")
+		return
+	}
+
+	// Ordered by name
+	c, p := res.Tables[0], res.Tables[1]
+
+	if p.Name != "P" || p.WithoutRowid || len(p.Columns) != 2 || p.Columns[0].PK != 1 {
+		t.Error("wrong table P")
+		return
+	}
+	if name := p.Columns[1]; name.Nullable || name.Default == nil || *name.Default != "'x'" {
+		t.Error("wrong column NAME")
+		return
+	}
+
+	if !c.WithoutRowid || c.Columns[1].PK != 2 || len(c.Indexes) != 3 {
+		t.Error("wrong table C")
+		return
+	}
+	if c.Indexes[0].Name != "C_VAL" || c.Indexes[0].Unique || !slices.Equal(c.Indexes[0].Columns, []string{"VAL", "P_ID"}) {
+		t.Error("wrong index C_VAL")
+		return
+	}
+	if len(c.ForeignKeys) != 1 || c.ForeignKeys[0].Table != "P" || c.ForeignKeys[0].OnDelete != "CASCADE" || !slices.Equal(c.ForeignKeys[0].Columns, []string{"P_ID"}) {
+		t.Error("wrong foreign key")
+		return
+	}
+
+	if res.Views[0].Name != "V" || len(res.Views[0].Columns) != 1 || res.Views[0].Sql == "" {
+		t.Error("wrong view")
+		return
+	}
+
+	if res.Triggers[0].Name != "TR" || res.Triggers[0].Table != "P" {
+		t.Error("wrong trigger")
+	}
+}
+
+func TestSchemaAuth(t *testing.T) {
+	if code, _ := callSchema("schemainline", "", "", t); code != 401 {
+		t.Error("called without credentials")
+		return
+	}
+
+	code, res := callSchema("schemainline", "pietro", "hey", t)
+	if code != 200 || len(res.Tables) != 0 {
+		t.Error("failed with right credentials")
+	}
+}
+
+func TestSchemaNotEnabled(t *testing.T) {
+	if code, _ := callSchema("noschema", "", "", t); code != 404 && code != 405 {
+		t.Error("the schema route is enabled without schemaRoute")
+	}
+}
+
+func TestSchemaTeardown(t *testing.T) {
+	time.Sleep(time.Second)
+	Shutdown()
+}
@@ -0,0 +1,111 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+
+	mllog "github.com/proofrock/go-mylittlelogger"
+	"github.com/wI2L/jettison"
+)
+
+// Writes the results of a transaction as NDJSON (one JSON object per line),
+// so that the rows don't need to be kept in memory. For each query, it writes
+// a line with the headers, then a line per row:
+//
+//	{"reqIdx":0,"resultHeaders":["ID","VAL"]}
+//	{"reqIdx":0,"row":[1,"ONE"]}
+//
+// and a final line (the trailer) with the outcome of the transaction, and the
+// outcome of the single items (without the rows, of course).
+type ndjsonStream struct {
+	w      *bufio.Writer
+	reqIdx int
+}
+
+func (s *ndjsonStream) writeLine(obj any) error {
+	bs, err := jettison.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	if _, err = s.w.Write(bs); err != nil {
+		return err
+	}
+	return s.w.WriteByte('\n')
+}
+
+func (s *ndjsonStream) writeHeaders(headers []string) error {
+	return s.writeLine(streamHeaders{s.reqIdx, headers})
+}
+
+func (s *ndjsonStream) writeRow(values []interface{}) error {
+	return s.writeLine(streamRow{s.reqIdx, values})
+}
+
+// Executes the transaction, streaming the results to the writer. It's called
+// by fasthttp after the handler returned, so it must take care of the locking
+// and of the errors by itself: after the first line is sent, the status code
+// can't be changed anymore, so the failures are reported in the trailer.
+func streamTransaction(db *db, body *request, w *bufio.Writer) {
+	stream := &ndjsonStream{w: w}
+	trailer := streamTrailer{}
+
+	defer func() {
+		if err := stream.writeLine(trailer); err != nil {
+			mllog.Errorf("in writing the stream trailer: %s", err.Error())
+			return
+		}
+		w.Flush()
+	}()
+
+	// Execute non-concurrently
+	if err := lockDb(db); err != nil {
+		trailer.Error = capitalize(err.Error())
+		return
+	}
+	defer db.Mutex.Unlock()
+
+	ctx, cancel := newRequestContext(db)
+	defer cancel()
+
+	tx, err := startTx(ctx, db, body.TxMode, db.ReadOnly)
+	if err != nil {
+		trailer.Error = capitalize(err.Error())
+		return
+	}
+
+	results, err := processItemsRecovering(ctx, db, tx, body, stream)
+	if err != nil {
+		tx.Rollback()
+		if wse, ok := err.(wsError); ok && wse.RequestIdx >= 0 {
+			trailer.RequestIdx = &wse.RequestIdx
+		}
+		trailer.Error = capitalize(err.Error())
+		return
+	}
+
+	if body.DryRun {
+		tx.Rollback()
+		trailer.DryRun = true
+	} else if err = commitTx(ctx, db, tx); err != nil {
+		trailer.Error = capitalize(err.Error())
+		return
+	}
+
+	trailer.Success = true
+	trailer.Results = results
+}
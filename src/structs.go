@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/iancoleman/orderedmap"
 )
@@ -74,27 +75,47 @@ type authr struct {
 }
 
 type storedStatement struct {
-	Id  string `yaml:"id"`
-	Sql string `yaml:"sql"`
+	Id       string `yaml:"id"`
+	Sql      string `yaml:"sql"`
+	AllowGet bool   `yaml:"allowGet"` // can be called with GET /<dbId>/<id>
 }
 
 type db struct {
-	Id                      string
-	Path                    string
-	CompanionFilePath       string
-	Auth                    *authr            `yaml:"auth"`
-	ReadOnly                bool              `yaml:"readOnly"`
-	CORSOrigin              string            `yaml:"corsOrigin"`
-	UseOnlyStoredStatements bool              `yaml:"useOnlyStoredStatements"`
-	DisableWALMode          bool              `yaml:"disableWALMode"`
-	Maintenance             *scheduledTask    `yaml:"maintenance"`
-	ScheduledTasks          []scheduledTask   `yaml:"scheduledTasks"`
-	StoredStatement         []storedStatement `yaml:"storedStatements"`
-	InitStatements          []string          `yaml:"initStatements"`
-	Db                      *sql.DB
-	DbConn                  *sql.Conn
-	StoredStatsMap          map[string]string
-	Mutex                   *sync.Mutex
+	Id                       string
+	Path                     string
+	CompanionFilePath        string
+	Auth                     *authr            `yaml:"auth"`
+	ReadOnly                 bool              `yaml:"readOnly"`
+	CORSOrigin               string            `yaml:"corsOrigin"`
+	UseOnlyStoredStatements  bool              `yaml:"useOnlyStoredStatements"`
+	InteractiveTx            bool              `yaml:"interactiveTx"`
+	InteractiveTxIdleSecs    int               `yaml:"interactiveTxIdleSecs"`
+	InteractiveTxMaxSecs     int               `yaml:"interactiveTxMaxSecs"`
+	CursorIdleSecs           int               `yaml:"cursorIdleSecs"`
+	MaxCursors               int               `yaml:"maxCursors"`
+	TimeoutMillis            int               `yaml:"timeoutMillis"`
+	TxMode                   string            `yaml:"txMode"`
+	BusyTimeoutMillis        int               `yaml:"busyTimeoutMillis"`
+	BusyRetries              int               `yaml:"busyRetries"`
+	WebSocket                bool              `yaml:"webSocket"`
+	TableRoutes              bool              `yaml:"tableRoutes"`
+	SchemaRoute              bool              `yaml:"schemaRoute"`
+	Idempotency              bool              `yaml:"idempotency"`
+	IdempotencyRetentionSecs int               `yaml:"idempotencyRetentionSecs"`
+	EnableChangeFeed         bool              `yaml:"changeFeed"`
+	ChangeFeedBufferSize     int               `yaml:"changeFeedBufferSize"`
+	MaxRows                  int               `yaml:"maxRows"`
+	FailOnMaxRows            bool              `yaml:"failOnMaxRows"`
+	DisableWALMode           bool              `yaml:"disableWALMode"`
+	Maintenance              *scheduledTask    `yaml:"maintenance"`
+	ScheduledTasks           []scheduledTask   `yaml:"scheduledTasks"`
+	StoredStatement          []storedStatement `yaml:"storedStatements"`
+	InitStatements           []string          `yaml:"initStatements"`
+	Db                       *sql.DB
+	DbConn                   *sql.Conn
+	StoredStatsMap           map[string]string
+	ChangeFeed               *changeFeed
+	Mutex                    *sync.Mutex
 }
 
 type config struct {
@@ -102,6 +123,10 @@ type config struct {
 	Port      int
 	Databases []db
 	ServeDir  *string
+	OpenAPI   bool
+	// Algorithms to compress the responses (and decompress the requests), if any
+	Compression        []string
+	CompressionMinSize int
 }
 
 // These are for parsing the request (from JSON)
@@ -112,17 +137,34 @@ type credentials struct {
 }
 
 type requestItem struct {
-	Query       string            `json:"query"`
-	Statement   string            `json:"statement"`
-	NoFail      bool              `json:"noFail"`
-	Values      json.RawMessage   `json:"values"`
-	ValuesBatch []json.RawMessage `json:"valuesBatch"`
+	Query         string            `json:"query"`
+	Statement     string            `json:"statement"`
+	Precondition  string            `json:"precondition"`
+	NoFail        bool              `json:"noFail"`
+	PageSize      int               `json:"pageSize"`
+	TimeoutMillis int               `json:"timeoutMillis"`
+	Limit         int               `json:"limit"`
+	Explain       bool              `json:"explain"`
+	Values        json.RawMessage   `json:"values"`
+	ValuesBatch   []json.RawMessage `json:"valuesBatch"`
+}
+
+type csvOptions struct {
+	Delimiter string `json:"delimiter"`
+	NoHeader  bool   `json:"noHeader"`
 }
 
 type request struct {
-	ResultFormat *string       `json:"resultFormat"`
-	Credentials  *credentials  `json:"credentials"`
-	Transaction  []requestItem `json:"transaction"`
+	Version        int           `json:"version"` // of the protocol; 0 is the same as 1
+	ResultFormat   *string       `json:"resultFormat"`
+	CSVOptions     *csvOptions   `json:"csvOptions"`
+	ResultTypes    bool          `json:"resultTypes"`
+	BlobFormat     *string       `json:"blobFormat"`
+	Credentials    *credentials  `json:"credentials"`
+	DryRun         bool          `json:"dryRun"`
+	IdempotencyKey string        `json:"idempotencyKey"`
+	TxMode         string        `json:"txMode"`
+	Transaction    []requestItem `json:"transaction"`
 }
 
 type requestParams struct {
@@ -132,16 +174,181 @@ type requestParams struct {
 
 // These are for generating the response
 
+type resultType struct {
+	DeclaredType   string   `json:"declaredType"`
+	Nullable       *bool    `json:"nullable,omitempty"`
+	StorageClasses []string `json:"storageClasses"`
+}
+
 type responseItem struct {
-	Success          bool                    `json:"success"`
-	RowsUpdated      *int64                  `json:"rowsUpdated,omitempty"`
-	RowsUpdatedBatch []int64                 `json:"rowsUpdatedBatch,omitempty"`
-	ResultHeaders    []string                `json:"resultHeaders,omitempty"`
-	ResultSet        []orderedmap.OrderedMap `json:"resultSet,omitnil"`     // omitnil is used by jettison
-	ResultSetList    [][]interface{}         `json:"resultSetList,omitnil"` // omitnil is used by jettison
-	Error            string                  `json:"error,omitempty"`
+	Success            bool                      `json:"success"`
+	RowsUpdated        *int64                    `json:"rowsUpdated,omitempty"`
+	RowsUpdatedBatch   []int64                   `json:"rowsUpdatedBatch,omitempty"`
+	LastInsertId       *int64                    `json:"lastInsertId,omitempty"`
+	LastInsertIdBatch  []int64                   `json:"lastInsertIdBatch,omitempty"`
+	ResultHeaders      []string                  `json:"resultHeaders,omitempty"`
+	ResultTypes        []resultType              `json:"resultTypes,omitempty"`
+	ResultSet          []orderedmap.OrderedMap   `json:"resultSet,omitnil"`          // omitnil is used by jettison
+	ResultSetList      [][]interface{}           `json:"resultSetList,omitnil"`      // omitnil is used by jettison
+	ResultSetBatch     [][]orderedmap.OrderedMap `json:"resultSetBatch,omitnil"`     // omitnil is used by jettison
+	ResultSetListBatch [][][]interface{}         `json:"resultSetListBatch,omitnil"` // omitnil is used by jettison
+	QueryPlan          []queryPlanRow            `json:"queryPlan,omitempty"`
+	Truncated          bool                      `json:"truncated,omitempty"`
+	Cursor             string                    `json:"cursor,omitempty"`
+	Error              string                    `json:"error,omitempty"`
+	errCode            int                       // HTTP status of the error, for v2 (see responseItemV2)
+	elapsed            time.Duration             // for v2
+}
+
+type queryPlanRow struct {
+	Id     int    `json:"id"`
+	Parent int    `json:"parent"`
+	Detail string `json:"detail"`
 }
 
 type response struct {
 	Results []responseItem `json:"results"`
+	DryRun  bool           `json:"dryRun,omitempty"` // the transaction was rolled back
+}
+
+// Version 2 of the protocol: the items and the response have typed errors,
+// and there are metadata and the timings of the execution
+
+type errorV2 struct {
+	Type       string `json:"type"` // see errorTypes
+	Message    string `json:"message"`
+	RequestIdx *int   `json:"reqIdx,omitempty"`
+}
+
+type responseItemV2 struct {
+	responseItem
+	Error         *errorV2 `json:"error,omitempty"` // shadows the one of responseItem
+	ElapsedMicros int64    `json:"elapsedMicros"`
+}
+
+type responseMetaV2 struct {
+	DbId          string `json:"dbId"`
+	ServerVersion string `json:"serverVersion"`
+	DryRun        bool   `json:"dryRun"`
+	ElapsedMicros int64  `json:"elapsedMicros"`
+}
+
+type responseV2 struct {
+	Version int              `json:"version"`
+	Success bool             `json:"success"`
+	Results []responseItemV2 `json:"results,omitnil"` // omitnil is used by jettison
+	Error   *errorV2         `json:"error,omitempty"`
+	Meta    responseMetaV2   `json:"meta"`
+}
+
+type interactiveTxResponse struct {
+	TxId    string `json:"txId"`
+	Success bool   `json:"success"`
+}
+
+// A message received on a WebSocket: a request, with an action and a
+// correlation id, that is copied as is in the response
+type wsRequest struct {
+	Id          json.RawMessage `json:"id"`
+	Action      string          `json:"action"`
+	Tables      []string        `json:"tables"`      // for "subscribe"
+	LastEventId *uint64         `json:"lastEventId"` // for "subscribe"
+	request
+}
+
+type wsResponse struct {
+	Id         json.RawMessage `json:"id,omitempty"`
+	Success    bool            `json:"success"`
+	TxId       string          `json:"txId,omitempty"`
+	Results    []responseItem  `json:"results,omitnil"` // omitnil is used by jettison
+	Event      *changeEvent    `json:"event,omitempty"`
+	Reset      bool            `json:"reset,omitempty"` // some events were lost
+	RequestIdx *int            `json:"reqIdx,omitempty"`
+	Code       int             `json:"code,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+type changeEvent struct {
+	Id    uint64 `json:"id"`
+	Table string `json:"table"`
+	Op    string `json:"op"` // insert, update or delete
+	RowId int64  `json:"rowid"`
+}
+
+type cursorResponse struct {
+	Cursor  string `json:"cursor"`
+	Success bool   `json:"success"`
+}
+
+// These are for describing the schema of a database, see schemaHandler
+
+type schemaColumn struct {
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Nullable bool    `json:"nullable"`
+	Default  *string `json:"default"` // as SQL
+	PK       int     `json:"pk"`      // position in the primary key, 0 if not in it
+}
+
+type schemaIndex struct {
+	Name    string   `json:"name"`
+	Unique  bool     `json:"unique"`
+	Origin  string   `json:"origin"` // c (CREATE INDEX), u (UNIQUE) or pk
+	Partial bool     `json:"partial"`
+	Columns []string `json:"columns"`
+}
+
+type schemaForeignKey struct {
+	Columns   []string `json:"columns"`
+	Table     string   `json:"table"`
+	ToColumns []string `json:"toColumns"`
+	OnUpdate  string   `json:"onUpdate"`
+	OnDelete  string   `json:"onDelete"`
+}
+
+type schemaTable struct {
+	Name         string             `json:"name"`
+	WithoutRowid bool               `json:"withoutRowid"`
+	Strict       bool               `json:"strict"`
+	Columns      []schemaColumn     `json:"columns"`
+	Indexes      []schemaIndex      `json:"indexes"`
+	ForeignKeys  []schemaForeignKey `json:"foreignKeys"`
+}
+
+type schemaView struct {
+	Name    string         `json:"name"`
+	Columns []schemaColumn `json:"columns"`
+	Sql     string         `json:"sql"`
+}
+
+type schemaTrigger struct {
+	Name  string `json:"name"`
+	Table string `json:"table"`
+	Sql   string `json:"sql"`
+}
+
+type schemaResponse struct {
+	Tables   []schemaTable   `json:"tables"`
+	Views    []schemaView    `json:"views"`
+	Triggers []schemaTrigger `json:"triggers"`
+}
+
+// These are for streaming the response (NDJSON), see ndjsonStream
+
+type streamHeaders struct {
+	RequestIdx    int      `json:"reqIdx"`
+	ResultHeaders []string `json:"resultHeaders"`
+}
+
+type streamRow struct {
+	RequestIdx int           `json:"reqIdx"`
+	Row        []interface{} `json:"row"`
+}
+
+type streamTrailer struct {
+	Success    bool           `json:"success"`
+	RequestIdx *int           `json:"reqIdx,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Results    []responseItem `json:"results,omitnil"` // omitnil is used by jettison
+	DryRun     bool           `json:"dryRun,omitempty"`
 }
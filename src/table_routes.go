@@ -0,0 +1,382 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// With tableRoutes, each table of the database can be accessed with REST
+// calls, without writing SQL:
+//
+//	GET    /<dbId>/tables/<table>        lists the rows, see tableListHandler()
+//	GET    /<dbId>/tables/<table>/<pk>   returns a row
+//	POST   /<dbId>/tables/<table>        inserts a row, from a JSON object
+//	PATCH  /<dbId>/tables/<table>/<pk>   updates a row, from a JSON object
+//	DELETE /<dbId>/tables/<table>/<pk>   deletes a row
+//
+// The SQL is built from the structure of the table, as read from the database
+// at each call. The responses are the same as for a POST request with a single
+// item; the statements use RETURNING, so they return the rows they touched.
+// For a table without a primary key, the rowid is returned as a column.
+
+const (
+	tableParamOrderBy = "_orderBy"
+	tableParamLimit   = "_limit"
+	tableParamOffset  = "_offset"
+)
+
+type tableInfo struct {
+	Name    string
+	Columns map[string]string // lowercase name -> name
+	PK      string            // column to use for <pk>, "" if there's none
+}
+
+// Reads the structure of a table. The caller must hold the mutex of the database.
+func lookupTable(db *db, name string) (*tableInfo, error) {
+	ret := tableInfo{Columns: make(map[string]string)}
+
+	var withoutRowid bool
+	err := db.DbConn.QueryRowContext(context.Background(),
+		"SELECT name, wr FROM pragma_table_list WHERE schema = 'main' AND type = 'table' AND name = ? COLLATE NOCASE AND name NOT LIKE 'sqlite\\_%' ESCAPE '\\' AND name NOT LIKE '\\_ws4sqlite\\_%' ESCAPE '\\'",
+		name).Scan(&ret.Name, &withoutRowid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, newWSErrorf(-1, fiber.StatusNotFound, "table '%s' not found", name)
+	} else if err != nil {
+		return nil, newWSError(-1, fiber.StatusInternalServerError, err.Error())
+	}
+
+	rows, err := db.DbConn.QueryContext(context.Background(), "SELECT name, pk FROM pragma_table_info(?)", ret.Name)
+	if err != nil {
+		return nil, newWSError(-1, fiber.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	var pks []string
+	for rows.Next() {
+		var column string
+		var pk int
+		if err := rows.Scan(&column, &pk); err != nil {
+			return nil, newWSError(-1, fiber.StatusInternalServerError, err.Error())
+		}
+		ret.Columns[strings.ToLower(column)] = column
+		if pk > 0 {
+			pks = append(pks, column)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, newWSError(-1, fiber.StatusInternalServerError, err.Error())
+	}
+
+	if len(pks) == 1 {
+		ret.PK = pks[0]
+	} else if !withoutRowid {
+		// The rowid is selected too, and can be used as a column
+		ret.PK = "rowid"
+		ret.Columns[ret.PK] = ret.PK
+	}
+
+	return &ret, nil
+}
+
+// The columns to select or return. "*" doesn't include the rowid, that the
+// client needs when it's the key of the rows.
+func (ti *tableInfo) selection() string {
+	if ti.PK == "rowid" {
+		return "rowid, *"
+	}
+	return "*"
+}
+
+func (ti *tableInfo) column(name string) (string, error) {
+	ret, found := ti.Columns[strings.ToLower(name)]
+	if !found {
+		return "", newWSErrorf(-1, fiber.StatusBadRequest, "column '%s' not found in table '%s'", name, ti.Name)
+	}
+	return ret, nil
+}
+
+// The condition on the primary key, and its value
+func (ti *tableInfo) pkCondition(c *fiber.Ctx) (string, json.RawMessage, error) {
+	if ti.PK == "" {
+		return "", nil, newWSErrorf(-1, fiber.StatusBadRequest, "table '%s' has a composite primary key, it cannot be accessed by key", ti.Name)
+	}
+
+	pk, err := url.PathUnescape(c.Params("pk"))
+	if err != nil {
+		return "", nil, newWSErrorf(-1, fiber.StatusBadRequest, "invalid URL path encoding: %s", err.Error())
+	}
+
+	val, _ := json.Marshal(queryParam2value(pk))
+	return quoteIdent(ti.PK) + " = ?", val, nil
+}
+
+// Decodes the body, a JSON object with the values of the columns
+func (ti *tableInfo) bodyValues(c *fiber.Ctx) (columns []string, values []json.RawMessage, err error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(c.Body(), &obj); err != nil {
+		return nil, nil, newWSErrorf(-1, fiber.StatusBadRequest, "in parsing body, it must be a JSON object: %s", err.Error())
+	}
+
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		column, err := ti.column(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		columns = append(columns, column)
+		values = append(values, obj[key])
+	}
+	return columns, values, nil
+}
+
+func rawArray(values []json.RawMessage) json.RawMessage {
+	bs, _ := json.Marshal(values)
+	return bs
+}
+
+// Wraps the handlers of the table routes. The function builds the request to
+// execute; if byPk, when no row is found the response is a 404.
+func tableHandler(databaseId string, write bool, byPk bool, f func(c *fiber.Ctx, ti *tableInfo) (*requestItem, error)) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		db, err := lookupDb(databaseId)
+		if err != nil {
+			return err
+		}
+
+		// Execute non-concurrently
+		if err := lockDb(&db); err != nil {
+			return err
+		}
+		defer db.Mutex.Unlock()
+
+		if err := ckInlineAuthHeader(&db, c); err != nil {
+			return err
+		}
+
+		if write && db.ReadOnly {
+			return newWSError(-1, fiber.StatusMethodNotAllowed, "the database is read only")
+		}
+
+		tableName, err := url.PathUnescape(c.Params("table"))
+		if err != nil {
+			return newWSErrorf(-1, fiber.StatusBadRequest, "invalid URL path encoding: %s", err.Error())
+		}
+
+		ti, err := lookupTable(&db, tableName)
+		if err != nil {
+			return err
+		}
+
+		item, err := f(c, ti)
+		if err != nil {
+			return err
+		}
+		body := request{Transaction: []requestItem{*item}}
+
+		ctx, cancel := newRequestContext(&db)
+		defer cancel()
+
+		tx, err := startTx(ctx, &db, "", db.ReadOnly || !write)
+		if err != nil {
+			return err
+		}
+
+		tainted := true // If I reach the end of the method, I switch this to false to signal success
+		defer func() {
+			if tainted {
+				tx.Rollback()
+			}
+		}()
+
+		results := processItems(ctx, &db, tx, &body, nil)
+
+		if byPk && len(results[0].ResultSet) == 0 {
+			return newWSErrorf(-1, fiber.StatusNotFound, "row not found in table '%s'", ti.Name)
+		}
+
+		if write {
+			if err := commitTx(ctx, &db, tx); err != nil {
+				return err
+			}
+			tainted = false
+		}
+
+		status := fiber.StatusOK
+		if c.Method() == fiber.MethodPost {
+			status = fiber.StatusCreated
+		}
+		return sendResponse(c, status, response{Results: results})
+	}
+}
+
+// Lists the rows of a table. The query parameters filter on the values of the
+// columns (e.g. "?name=Pietro"); "_orderBy" is a comma-separated list of
+// columns, each optionally prefixed by "-" for descending order; "_limit" and
+// "_offset" paginate.
+func tableListHandler(databaseId string) func(c *fiber.Ctx) error {
+	return tableHandler(databaseId, false, false, func(c *fiber.Ctx, ti *tableInfo) (*requestItem, error) {
+		var conditions, orderBy []string
+		var values []json.RawMessage
+		limit, offset := "", ""
+
+		for key, value := range c.Queries() {
+			switch key {
+			case tableParamOrderBy:
+				for _, col := range strings.Split(value, ",") {
+					dir := "ASC"
+					if rest, found := strings.CutPrefix(col, "-"); found {
+						col, dir = rest, "DESC"
+					}
+					column, err := ti.column(col)
+					if err != nil {
+						return nil, err
+					}
+					orderBy = append(orderBy, quoteIdent(column)+" "+dir)
+				}
+			case tableParamLimit, tableParamOffset:
+				if n, err := strconv.Atoi(value); err != nil || n < 0 {
+					return nil, newWSErrorf(-1, fiber.StatusBadRequest, "%s must be a non-negative integer", key)
+				}
+				if key == tableParamLimit {
+					limit = value
+				} else {
+					offset = value
+				}
+			default:
+				column, err := ti.column(key)
+				if err != nil {
+					return nil, err
+				}
+				val, _ := json.Marshal(queryParam2value(value))
+				conditions = append(conditions, quoteIdent(column)+" = ?")
+				values = append(values, val)
+			}
+		}
+
+		sql := "SELECT " + ti.selection() + " FROM " + quoteIdent(ti.Name)
+		if len(conditions) > 0 {
+			// The order of the parameters is random, but the one of the values follows it
+			sql += " WHERE " + strings.Join(conditions, " AND ")
+		}
+		if len(orderBy) > 0 {
+			sql += " ORDER BY " + strings.Join(orderBy, ", ")
+		}
+		if limit != "" || offset != "" {
+			if limit == "" {
+				limit = "-1"
+			}
+			if offset == "" {
+				offset = "0"
+			}
+			sql += fmt.Sprintf(" LIMIT %s OFFSET %s", limit, offset)
+		}
+
+		return &requestItem{Query: sql, Values: rawArray(values)}, nil
+	})
+}
+
+func tableGetHandler(databaseId string) func(c *fiber.Ctx) error {
+	return tableHandler(databaseId, false, true, func(c *fiber.Ctx, ti *tableInfo) (*requestItem, error) {
+		cond, val, err := ti.pkCondition(c)
+		if err != nil {
+			return nil, err
+		}
+		return &requestItem{
+			Query:  fmt.Sprintf("SELECT %s FROM %s WHERE %s", ti.selection(), quoteIdent(ti.Name), cond),
+			Values: rawArray([]json.RawMessage{val}),
+		}, nil
+	})
+}
+
+func tableInsertHandler(databaseId string) func(c *fiber.Ctx) error {
+	return tableHandler(databaseId, true, false, func(c *fiber.Ctx, ti *tableInfo) (*requestItem, error) {
+		columns, values, err := ti.bodyValues(c)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(columns) == 0 {
+			return &requestItem{Statement: fmt.Sprintf("INSERT INTO %s DEFAULT VALUES RETURNING %s", quoteIdent(ti.Name), ti.selection())}, nil
+		}
+
+		quoted := make([]string, len(columns))
+		for i := range columns {
+			quoted[i] = quoteIdent(columns[i])
+		}
+		return &requestItem{
+			Statement: fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) RETURNING %s",
+				quoteIdent(ti.Name), strings.Join(quoted, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "), ti.selection()),
+			Values: rawArray(values),
+		}, nil
+	})
+}
+
+func tableUpdateHandler(databaseId string) func(c *fiber.Ctx) error {
+	return tableHandler(databaseId, true, true, func(c *fiber.Ctx, ti *tableInfo) (*requestItem, error) {
+		cond, pkVal, err := ti.pkCondition(c)
+		if err != nil {
+			return nil, err
+		}
+
+		columns, values, err := ti.bodyValues(c)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(columns) == 0 {
+			return nil, newWSError(-1, fiber.StatusBadRequest, "no columns to update")
+		}
+
+		sets := make([]string, len(columns))
+		for i := range columns {
+			sets[i] = quoteIdent(columns[i]) + " = ?"
+		}
+		return &requestItem{
+			Statement: fmt.Sprintf("UPDATE %s SET %s WHERE %s RETURNING %s", quoteIdent(ti.Name), strings.Join(sets, ", "), cond, ti.selection()),
+			Values:    rawArray(append(values, pkVal)),
+		}, nil
+	})
+}
+
+func tableDeleteHandler(databaseId string) func(c *fiber.Ctx) error {
+	return tableHandler(databaseId, true, true, func(c *fiber.Ctx, ti *tableInfo) (*requestItem, error) {
+		cond, val, err := ti.pkCondition(c)
+		if err != nil {
+			return nil, err
+		}
+		return &requestItem{
+			Statement: fmt.Sprintf("DELETE FROM %s WHERE %s RETURNING %s", quoteIdent(ti.Name), cond, ti.selection()),
+			Values:    rawArray([]json.RawMessage{val}),
+		}, nil
+	})
+}
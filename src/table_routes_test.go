@@ -0,0 +1,251 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func callTable(method, path, body, user, password string, t *testing.T) (int, response) {
+	req, err := http.NewRequest(method, "http://localhost:12321/"+path, bytes.NewBufferString(body))
+	if err != nil {
+		t.Error(err)
+		return -1, response{}
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return -1, response{}
+	}
+	defer resp.Body.Close()
+
+	var ret response
+	if resp.StatusCode < 300 {
+		bs, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(bs, &ret); err != nil {
+			t.Error(err)
+		}
+	}
+	return resp.StatusCode, ret
+}
+
+func TestTableRoutesSetup(t *testing.T) {
+	os.Remove("../test/tblro.db")
+	dbObj, err := sql.Open("sqlite", "../test/tblro.db")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = dbObj.Exec("CREATE TABLE T (ID INTEGER PRIMARY KEY); INSERT INTO T VALUES (1)")
+	dbObj.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:          "tbl",
+				Path:        ":memory:",
+				TableRoutes: true,
+				InitStatements: []string{
+					"CREATE TABLE T (ID INTEGER PRIMARY KEY, VAL TEXT, N INT)",
+					"INSERT INTO T VALUES (1, 'ONE', 10), (2, 'TWO', 20), (3, 'THREE', 20)",
+					"CREATE TABLE NOPK (VAL TEXT)",
+					"INSERT INTO NOPK VALUES ('A')",
+					"CREATE TABLE COMP (A INT, B INT, PRIMARY KEY (A, B)) WITHOUT ROWID",
+				},
+			},
+			{
+				Id:          "tblro",
+				Path:        "../test/tblro.db",
+				ReadOnly:    true,
+				TableRoutes: true,
+			},
+			{
+				Id:          "tblauth",
+				Path:        ":memory:",
+				TableRoutes: true,
+				Auth: &authr{
+					Mode:          "INLINE",
+					ByCredentials: []credentialsCfg{{User: "pietro", Password: "hey"}},
+				},
+				InitStatements: []string{"CREATE TABLE T (ID INTEGER PRIMARY KEY)"},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestTableList(t *testing.T) {
+	code, res := callTable("GET", "tbl/tables/T", "", "", "", t)
+	if code != 200 || len(res.Results[0].ResultSet) != 3 {
+		t.Error("wrong result")
+		return
+	}
+
+	code, res = callTable("GET", "tbl/tables/t?n=20&_orderBy=-id", "", "", "", t)
+	if code != 200 || len(res.Results[0].ResultSet) != 2 || getDefault[string](res.Results[0].ResultSet[0], "VAL") != "THREE" {
+		t.Error("wrong result with filter and order")
+		return
+	}
+
+	code, res = callTable("GET", "tbl/tables/T?_orderBy=ID&_limit=1&_offset=1", "", "", "", t)
+	if code != 200 || len(res.Results[0].ResultSet) != 1 || getDefault[string](res.Results[0].ResultSet[0], "VAL") != "TWO" {
+		t.Error("wrong result with pagination")
+		return
+	}
+
+	for _, path := range []string{"tbl/tables/T?NOPE=1", "tbl/tables/T?_orderBy=NOPE", "tbl/tables/T?_limit=-1"} {
+		if code, _ = callTable("GET", path, "", "", "", t); code != 400 {
+			t.Error("did not fail on", path)
+			return
+		}
+	}
+
+	if code, _ = callTable("GET", "tbl/tables/NOPE", "", "", "", t); code != 404 {
+		t.Error("listed a non-existent table")
+	}
+}
+
+func TestTableGet(t *testing.T) {
+	code, res := callTable("GET", "tbl/tables/T/2", "", "", "", t)
+	if code != 200 || len(res.Results[0].ResultSet) != 1 || getDefault[string](res.Results[0].ResultSet[0], "VAL") != "TWO" {
+		t.Error("wrong result")
+		return
+	}
+
+	if code, _ = callTable("GET", "tbl/tables/T/99", "", "", "", t); code != 404 {
+		t.Error("found a non-existent row")
+		return
+	}
+
+	// By rowid
+	code, res = callTable("GET", "tbl/tables/NOPK/1", "", "", "", t)
+	if code != 200 || getDefault[string](res.Results[0].ResultSet[0], "VAL") != "A" || getDefault[float64](res.Results[0].ResultSet[0], "rowid") != 1 {
+		t.Error("wrong result by rowid")
+		return
+	}
+
+	if code, _ = callTable("GET", "tbl/tables/COMP/1", "", "", "", t); code != 400 {
+		t.Error("accessed a composite primary key")
+	}
+}
+
+func TestTableWrite(t *testing.T) {
+	code, res := callTable("POST", "tbl/tables/T", `{"ID": 4, "VAL": "FOUR"}`, "", "", t)
+	if code != 201 || getDefault[float64](res.Results[0].ResultSet[0], "ID") != 4 {
+		t.Error("insert failed")
+		return
+	}
+
+	if code, _ = callTable("POST", "tbl/tables/T", `{"NOPE": 4}`, "", "", t); code != 400 {
+		t.Error("inserted a non-existent column")
+		return
+	}
+
+	code, res = callTable("PATCH", "tbl/tables/T/4", `{"VAL": "QUATTRO", "N": 40}`, "", "", t)
+	if code != 200 || getDefault[string](res.Results[0].ResultSet[0], "VAL") != "QUATTRO" {
+		t.Error("update failed")
+		return
+	}
+
+	if code, _ = callTable("PATCH", "tbl/tables/T/99", `{"VAL": "X"}`, "", "", t); code != 404 {
+		t.Error("updated a non-existent row")
+		return
+	}
+
+	if code, _ = callTable("DELETE", "tbl/tables/T/4", "", "", "", t); code != 200 {
+		t.Error("delete failed")
+		return
+	}
+
+	if code, _ = callTable("DELETE", "tbl/tables/T/4", "", "", "", t); code != 404 {
+		t.Error("deleted a non-existent row")
+		return
+	}
+
+	// Without a primary key, the rowid is returned and used as the key
+	code, res = callTable("POST", "tbl/tables/NOPK", `{"VAL": "B"}`, "", "", t)
+	if code != 201 || getDefault[float64](res.Results[0].ResultSet[0], "rowid") != 2 {
+		t.Error("the rowid was not returned")
+		return
+	}
+
+	code, res = callTable("GET", "tbl/tables/NOPK?_orderBy=-rowid", "", "", "", t)
+	if code != 200 || len(res.Results[0].ResultSet) != 2 || getDefault[float64](res.Results[0].ResultSet[0], "rowid") != 2 {
+		t.Error("the rowid was not listed")
+		return
+	}
+
+	code, res = callTable("PATCH", "tbl/tables/NOPK/2", `{"VAL": "C"}`, "", "", t)
+	if code != 200 || getDefault[float64](res.Results[0].ResultSet[0], "rowid") != 2 {
+		t.Error("update by rowid failed")
+		return
+	}
+
+	if code, _ = callTable("DELETE", "tbl/tables/NOPK/2", "", "", "", t); code != 200 {
+		t.Error("delete by rowid failed")
+	}
+}
+
+func TestTableReadOnly(t *testing.T) {
+	if code, _ := callTable("GET", "tblro/tables/T", "", "", "", t); code != 200 {
+		t.Error("list failed on a read only database")
+		return
+	}
+
+	if code, _ := callTable("POST", "tblro/tables/T", `{"ID": 2}`, "", "", t); code != 405 {
+		t.Error("inserted in a read only database")
+	}
+}
+
+func TestTableAuth(t *testing.T) {
+	if code, _ := callTable("GET", "tblauth/tables/T", "", "", "", t); code != 401 {
+		t.Error("called without credentials")
+		return
+	}
+
+	if code, _ := callTable("GET", "tblauth/tables/T", "", "pietro", "hey", t); code != 200 {
+		t.Error("failed with right credentials")
+	}
+}
+
+func TestTableRoutesTeardown(t *testing.T) {
+	time.Sleep(time.Second)
+	Shutdown()
+	os.Remove("../test/tblro.db")
+}
@@ -0,0 +1,118 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+const runawayQuery = "WITH RECURSIVE C(X) AS (SELECT 1 UNION ALL SELECT X + 1 FROM C) SELECT COUNT(1) FROM C"
+
+func TestTimeoutSetup(t *testing.T) {
+	os.Remove("../test/timeout.db")
+
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:            "timeout",
+				Path:          "../test/timeout.db",
+				TimeoutMillis: 500,
+				InitStatements: []string{
+					"CREATE TABLE T (ID INT PRIMARY KEY)",
+				},
+			},
+			{
+				Id:   "notimeout",
+				Path: ":memory:",
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestTimeoutRequest(t *testing.T) {
+	start := time.Now()
+	code, _, _ := call("timeout", request{Transaction: []requestItem{
+		{Statement: "INSERT INTO T VALUES (1)"},
+		{Query: runawayQuery, NoFail: true},
+	}}, t)
+	if code != 504 {
+		t.Error("did not time out:", code)
+		return
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("timed out too late")
+		return
+	}
+
+	// The transaction was rolled back, and the database is available
+	code, _, res := call("timeout", request{Transaction: []requestItem{{Query: "SELECT COUNT(1) AS C FROM T"}}}, t)
+	if code != 200 || getDefault[float64](res.Results[0].ResultSet[0], "C") != 0 {
+		t.Error("the transaction was not rolled back")
+	}
+}
+
+func TestTimeoutItem(t *testing.T) {
+	start := time.Now()
+	code, _, _ := call("notimeout", request{Transaction: []requestItem{{Query: runawayQuery, TimeoutMillis: 100}}}, t)
+	if code != 504 {
+		t.Error("did not time out:", code)
+		return
+	}
+	if time.Since(start) > time.Second {
+		t.Error("timed out too late")
+	}
+}
+
+func TestTimeoutItemCapped(t *testing.T) {
+	// An item cannot have a longer timeout than the database
+	start := time.Now()
+	code, _, _ := call("timeout", request{Transaction: []requestItem{{Query: runawayQuery, TimeoutMillis: 10000}}}, t)
+	if code != 504 {
+		t.Error("did not time out:", code)
+		return
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("timed out too late")
+	}
+}
+
+func TestTimeoutCursor(t *testing.T) {
+	code, _, _ := call("timeout", request{Transaction: []requestItem{{Query: runawayQuery, PageSize: 10}}}, t)
+	if code != 504 {
+		t.Error("did not time out:", code)
+	}
+}
+
+func TestTimeoutKO(t *testing.T) {
+	code, _, _ := call("notimeout", request{Transaction: []requestItem{{Query: "SELECT 1", TimeoutMillis: -1}}}, t)
+	if code != 400 {
+		t.Error("a negative timeout should not be accepted")
+	}
+}
+
+func TestTimeoutTeardown(t *testing.T) {
+	time.Sleep(time.Second)
+	Shutdown()
+	os.Remove("../test/timeout.db")
+}
@@ -0,0 +1,153 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// The transactions can be DEFERRED (the default of SQLite), IMMEDIATE or
+// EXCLUSIVE; the mode is configured for a database (txMode) and can be
+// overridden by a request. A transaction that is not deferred takes the
+// write lock when it begins, so it doesn't fail with SQLITE_BUSY while
+// upgrading the lock, when other processes write to the file.
+//
+// The mode of the database is passed to the driver (_txlock), that uses it
+// in BeginTx(). A request with a different mode begins the transaction
+// explicitly on the connection of the database.
+//
+// With busyRetries, a transaction that fails because the database is busy
+// or locked is retried (as a whole) with an exponential backoff; then, the
+// request fails with a 503.
+
+const (
+	txModeDeferred  = "deferred"
+	txModeImmediate = "immediate"
+	txModeExclusive = "exclusive"
+)
+
+const busyBackoffBase = 10 * time.Millisecond
+
+// A transaction, either a *sql.Tx or a connTx
+type dbTx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	Commit() error
+	Rollback() error
+}
+
+// A transaction begun with an explicit BEGIN on the connection. Like a
+// *sql.Tx, it's rolled back if the context is done before the commit.
+type connTx struct {
+	*sql.Conn
+	ctx  context.Context
+	done bool
+}
+
+func (t *connTx) Commit() error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	if err := t.ctx.Err(); err != nil {
+		t.Rollback()
+		return err
+	}
+	t.done = true
+	if _, err := t.Conn.ExecContext(context.Background(), "COMMIT"); err != nil {
+		// If the commit fails (e.g. the database is busy) the transaction
+		// is still open, and the connection must be cleaned up
+		t.Conn.ExecContext(context.Background(), "ROLLBACK")
+		return err
+	}
+	return nil
+}
+
+func (t *connTx) Rollback() error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.done = true
+	_, err := t.Conn.ExecContext(context.Background(), "ROLLBACK")
+	return err
+}
+
+// Normalizes a transaction mode, that may be empty
+func parseTxMode(mode string) (string, error) {
+	switch lower := strings.ToLower(mode); lower {
+	case "", txModeDeferred, txModeImmediate, txModeExclusive:
+		return lower, nil
+	default:
+		return "", errors.New("the transaction mode must be one of deferred, immediate or exclusive")
+	}
+}
+
+// Begins a transaction in the given mode, or in the one of the database if
+// it's empty.
+func startTx(ctx context.Context, db *db, mode string, readOnly bool) (dbTx, error) {
+	var tx dbTx
+	var err error
+	if readOnly || mode == "" || mode == db.TxMode || (mode == txModeDeferred && db.TxMode == "") {
+		tx, err = db.DbConn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: readOnly})
+	} else if _, err = db.DbConn.ExecContext(ctx, "BEGIN "+strings.ToUpper(mode)); err == nil {
+		tx = &connTx{Conn: db.DbConn, ctx: ctx}
+	}
+	if err != nil {
+		if isBusy(err) {
+			return nil, newWSError(-1, fiber.StatusServiceUnavailable, err.Error())
+		}
+		return nil, newWSError(-1, fiber.StatusInternalServerError, err.Error())
+	}
+	return tx, nil
+}
+
+// Tells if the error is because the database is busy or locked
+func isBusy(err error) bool {
+	var se *sqlite.Error
+	if !errors.As(err, &se) {
+		return false
+	}
+	code := se.Code() & 0xff // the primary code
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
+
+// Executes f, retrying it while it fails because the database is busy, up
+// to the busyRetries of the database and as long as the context is valid.
+func retryOnBusy(ctx context.Context, db *db, f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		var wse wsError
+		if !errors.As(err, &wse) || wse.Code != fiber.StatusServiceUnavailable || attempt >= db.BusyRetries {
+			return err
+		}
+
+		select {
+		case <-time.After(busyBackoffBase << attempt):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
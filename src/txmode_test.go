@@ -0,0 +1,242 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	txModeDbPath    = "../test/txmode.db"
+	txModeJrnDbPath = "../test/txmodejrn.db"
+)
+
+func removeTxModeDb() {
+	for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+		os.Remove(txModeDbPath + suffix)
+		os.Remove(txModeJrnDbPath + suffix)
+	}
+}
+
+// Takes a read lock on the database in rollback journal mode, from another
+// connection; it prevents the commits.
+func readLockTxModeJrnDb(t *testing.T) (*sql.DB, *sql.Conn) {
+	dbObj, err := sql.Open("sqlite", txModeJrnDbPath)
+	if err != nil {
+		t.Error(err)
+		return nil, nil
+	}
+	conn, err := dbObj.Conn(context.Background())
+	if err != nil {
+		t.Error(err)
+		return nil, nil
+	}
+	if _, err := conn.ExecContext(context.Background(), "BEGIN"); err != nil {
+		t.Error(err)
+		return nil, nil
+	}
+	if _, err := conn.ExecContext(context.Background(), "SELECT COUNT(1) FROM T"); err != nil {
+		t.Error(err)
+		return nil, nil
+	}
+	return dbObj, conn
+}
+
+// Takes the write lock of the database, from another connection
+func lockTxModeDb(t *testing.T) (*sql.DB, *sql.Conn) {
+	dbObj, err := sql.Open("sqlite", txModeDbPath)
+	if err != nil {
+		t.Error(err)
+		return nil, nil
+	}
+	conn, err := dbObj.Conn(context.Background())
+	if err != nil {
+		t.Error(err)
+		return nil, nil
+	}
+	if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Error(err)
+		return nil, nil
+	}
+	return dbObj, conn
+}
+
+func unlockTxModeDb(dbObj *sql.DB, conn *sql.Conn) {
+	conn.ExecContext(context.Background(), "COMMIT")
+	conn.Close()
+	dbObj.Close()
+}
+
+func TestTxModeSetup(t *testing.T) {
+	removeTxModeDb()
+
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:             "txmode",
+				Path:           txModeDbPath,
+				BusyRetries:    5,
+				InteractiveTx:  true,
+				InitStatements: []string{"CREATE TABLE T (ID INT)"},
+			},
+			{
+				Id:     "txmodeimm",
+				Path:   txModeDbPath,
+				TxMode: txModeImmediate,
+			},
+			{
+				Id:             "txmodejrn",
+				Path:           txModeJrnDbPath,
+				DisableWALMode: true,
+				BusyRetries:    5,
+				InitStatements: []string{"CREATE TABLE T (ID INT)"},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestTxModeInvalid(t *testing.T) {
+	code, _, _ := call("txmode", request{TxMode: "bogus", Transaction: []requestItem{{Query: "SELECT 1"}}}, t)
+	if code != 400 {
+		t.Error("an invalid transaction mode was accepted", code)
+	}
+
+	code, _ = callRawBA("txmode/tx", request{TxMode: "bogus"}, "", "", t)
+	if code != 400 {
+		t.Error("an invalid transaction mode was accepted for an interactive transaction", code)
+	}
+}
+
+func TestTxModeBusy(t *testing.T) {
+	dbObj, conn := lockTxModeDb(t)
+	if conn == nil {
+		return
+	}
+	defer unlockTxModeDb(dbObj, conn)
+
+	// A deferred transaction can read, in WAL mode
+	req := request{Transaction: []requestItem{{Query: "SELECT COUNT(1) FROM T"}}}
+	if code, _, _ := call("txmode", req, t); code != 200 {
+		t.Error("a deferred transaction failed", code)
+		return
+	}
+
+	// Writing fails, even in a noFail item
+	write := request{Transaction: []requestItem{{Statement: "INSERT INTO T VALUES (1)", NoFail: true}}}
+	if code, _, _ := call("txmode", write, t); code != 503 {
+		t.Error("a write didn't fail", code)
+		return
+	}
+
+	// An immediate one needs the write lock
+	req.TxMode = "IMMEDIATE"
+	if code, _, _ := call("txmode", req, t); code != 503 {
+		t.Error("an immediate transaction didn't fail", code)
+		return
+	}
+
+	req.Version = protocolV2
+	code, res := callV2("txmode", req, t)
+	if code != 503 || res.Error == nil || res.Error.Type != "BUSY" {
+		t.Error("wrong v2 response", code)
+		return
+	}
+
+	if code, _ = callRawBA("txmode/tx", request{TxMode: txModeExclusive}, "", "", t); code != 503 {
+		t.Error("an exclusive interactive transaction didn't fail", code)
+		return
+	}
+
+	// The mode of the database applies when the request doesn't set one
+	req = request{Transaction: []requestItem{{Query: "SELECT COUNT(1) FROM T"}}}
+	if code, _, _ := call("txmodeimm", req, t); code != 503 {
+		t.Error("a transaction in the mode of the database didn't fail", code)
+		return
+	}
+
+	req.TxMode = txModeDeferred
+	if code, _, _ := call("txmodeimm", req, t); code != 200 {
+		t.Error("a deferred transaction failed on an immediate database", code)
+	}
+}
+
+func TestTxModeRetry(t *testing.T) {
+	dbObj, conn := lockTxModeDb(t)
+	if conn == nil {
+		return
+	}
+
+	// The lock is released while retrying
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		unlockTxModeDb(dbObj, conn)
+	}()
+
+	req := request{TxMode: txModeImmediate, Transaction: []requestItem{{Statement: "INSERT INTO T VALUES (1)"}}}
+	if code, _, _ := call("txmode", req, t); code != 200 {
+		t.Error("the transaction was not retried", code)
+	}
+}
+
+func TestTxModeBusyCommit(t *testing.T) {
+	dbObj, conn := readLockTxModeJrnDb(t)
+	if conn == nil {
+		return
+	}
+
+	// The write succeeds, but the commit waits for the reader
+	req := request{Transaction: []requestItem{{Statement: "INSERT INTO T VALUES (1)"}}}
+	if code, _, _ := call("txmodejrn", req, t); code != 503 {
+		t.Error("the commit didn't fail", code)
+	}
+
+	// The reader ends while retrying
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		unlockTxModeDb(dbObj, conn)
+	}()
+
+	if code, _, _ := call("txmodejrn", req, t); code != 200 {
+		t.Error("the transaction was not retried", code)
+		return
+	}
+
+	count := request{Transaction: []requestItem{{Query: "SELECT COUNT(1) AS C FROM T"}}}
+	code, _, res := call("txmodejrn", count, t)
+	if code != 200 {
+		t.Error("the database is unusable after a failed commit", code)
+		return
+	}
+	if getDefault[float64](res.Results[0].ResultSet[0], "C") != 1 {
+		t.Error("the failed commit was not rolled back")
+	}
+}
+
+func TestTxModeTeardown(t *testing.T) {
+	time.Sleep(time.Second)
+	Shutdown()
+	removeTxModeDb()
+}
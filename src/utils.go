@@ -19,11 +19,15 @@ package main
 import (
 	"bytes"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/iancoleman/orderedmap"
@@ -67,6 +71,17 @@ func vals2nameds(vals map[string]interface{}) []interface{} {
 	return nameds
 }
 
+// How many of the strings are not empty
+func countNonEmpty(strs ...string) int {
+	ret := 0
+	for _, str := range strs {
+		if str != "" {
+			ret++
+		}
+	}
+	return ret
+}
+
 func isEmptyRaw(raw json.RawMessage) bool {
 	// the last check is for `null`
 	return len(raw) == 0 || slices.Equal(raw, []byte{110, 117, 108, 108})
@@ -97,9 +112,79 @@ func raw2params(raw json.RawMessage) (*requestParams, error) {
 		return nil, errors.New("values should be an array or an object")
 	}
 
+	if err := decodeTaggedValues(&params); err != nil {
+		return nil, err
+	}
+
 	return &params, nil
 }
 
+// Values can be "tagged", i.e. an object with a single key that starts with
+// '$', to represent something that JSON can't express natively:
+// {"$blob": "<base64>"} is converted to a []byte, and {"$int": "<digits>"}
+// to an int64 (JSON numbers are float64, that can't hold all of them).
+func decodeTaggedValues(params *requestParams) error {
+	var err error
+	for key, val := range params.UnmarshalledDict {
+		if params.UnmarshalledDict[key], err = decodeTaggedValue(val); err != nil {
+			return err
+		}
+	}
+	for i, val := range params.UnmarshalledArray {
+		if params.UnmarshalledArray[i], err = decodeTaggedValue(val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeTaggedValue(val any) (any, error) {
+	obj, ok := val.(map[string]interface{})
+	if !ok || len(obj) != 1 {
+		return val, nil
+	}
+	if blob, ok := obj[blobTag]; ok {
+		b64, ok := blob.(string)
+		if !ok {
+			return nil, errors.New("the value of a $blob must be a base64 string")
+		}
+		bs, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, fmt.Errorf("in decoding $blob: %s", err.Error())
+		}
+		return bs, nil
+	}
+	if i, ok := obj[intTag]; ok {
+		str, ok := i.(string)
+		if !ok {
+			return nil, errors.New("the value of an $int must be a string")
+		}
+		ret, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("in decoding $int: %s", err.Error())
+		}
+		return ret, nil
+	}
+	return val, nil
+}
+
+// A BLOB in the hex format. It's encoded as a string, but a reference to it
+// can tell it from a TEXT (see resolveRef()).
+type hexBlob string
+
+// Converts a BLOB, as read from the database, as specified by the request.
+// For base64 it leaves it as is, JSON encodes []byte that way.
+func encodeBlob(bs []byte, blobFormat string) interface{} {
+	switch blobFormat {
+	case blobFormatHex:
+		return hexBlob(hex.EncodeToString(bs))
+	case blobFormatTagged:
+		return map[string]string{blobTag: base64.StdEncoding.EncodeToString(bs)}
+	default:
+		return bs
+	}
+}
+
 // Processes paths with home (tilde) expansion. Fails if not valid
 func expandHomeDir(path string, desc string) string {
 	ePath, err := homedir.Expand(path)
@@ -17,18 +17,63 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"database/sql"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/iancoleman/orderedmap"
 
 	"github.com/gofiber/fiber/v2"
+	mllog "github.com/proofrock/go-mylittlelogger"
 )
 
+const (
+	resultFormatList         = "list"
+	resultFormatNDJSONStream = "ndjson-stream"
+	resultFormatCSV          = "csv"
+)
+
+const (
+	blobTag          = "$blob"
+	intTag           = "$int"
+	blobFormatBase64 = "base64"
+	blobFormatHex    = "hex"
+	blobFormatTagged = "tagged"
+)
+
+const (
+	protocolV1 = 1
+	protocolV2 = 2
+)
+
+// The types of the errors in v2 of the protocol, from the HTTP status
+var errorTypes = map[int]string{
+	fiber.StatusBadRequest:          "BAD_REQUEST",
+	fiber.StatusUnauthorized:        "UNAUTHORIZED",
+	fiber.StatusNotFound:            "NOT_FOUND",
+	fiber.StatusPreconditionFailed:  "PRECONDITION_FAILED",
+	fiber.StatusTooManyRequests:     "TOO_MANY_REQUESTS",
+	fiber.StatusInternalServerError: "EXECUTION_ERROR",
+	fiber.StatusServiceUnavailable:  "BUSY",
+	fiber.StatusGatewayTimeout:      "TIMEOUT",
+}
+
+const errTimeout = "timeout expired, the execution was interrupted"
+
+// The savepoint around each noFail item, see processItemInSavepoint()
+const noFailSavepoint = "ws4sqlite_nofail"
+
+var errTooManyRows = errors.New("the result set has too many rows")
+
 // Catches the panics and converts the argument in a struct that Fiber uses to
 // signal the error, setting the response code and the JSON that is actually returned
 // with all its properties.
@@ -48,7 +93,7 @@ func errHandler(c *fiber.Ctx, err error) error {
 		ret = newWSError(-1, fiber.StatusInternalServerError, capitalize(err.Error()))
 	}
 
-	return c.Status(ret.Code).JSON(ret)
+	return sendResponse(c, ret.Code, ret)
 }
 
 // For a single query item, deals with a failure, determining if it must invalidate all of the transaction
@@ -58,13 +103,26 @@ func reportError(err error, code int, reqIdx int, noFail bool, results []respons
 	if !noFail {
 		panic(newWSError(reqIdx, code, err.Error()))
 	}
-	results[reqIdx] = responseItem{false, nil, nil, nil, nil, nil, capitalize(err.Error())}
+	results[reqIdx] = responseItem{Success: false, Error: capitalize(err.Error()), errCode: code}
+}
+
+// Options that govern how a result set is built, from the request
+type resultSetOpts struct {
+	isList      bool
+	withTypes   bool
+	blobFormat  string
+	maxRows     int  // 0 means no limit
+	failOnLimit bool // if false, the result set is truncated
+	isCSV       bool
 }
 
 // Processes a query, and returns a suitable responseItem
 //
 // This method is needed to execute properly the defers.
-func processWithResultSet(tx *sql.Tx, query string, isListResultSet bool, params requestParams) (*responseItem, error) {
+//
+// If a stream is given, the headers and rows are written to it, and the
+// responseItem doesn't contain the result set.
+func processWithResultSet(ctx context.Context, tx dbTx, query string, opts resultSetOpts, params requestParams, stream *ndjsonStream) (*responseItem, error) {
 	resultSet := make([]orderedmap.OrderedMap, 0)
 	resultSetList := make([][]interface{}, 0)
 
@@ -73,9 +131,9 @@ func processWithResultSet(tx *sql.Tx, query string, isListResultSet bool, params
 	if params.UnmarshalledDict == nil && params.UnmarshalledArray == nil {
 		rows, err = nil, errors.New("processWithResultSet unreachable code")
 	} else if params.UnmarshalledDict != nil {
-		rows, err = tx.Query(query, vals2nameds(params.UnmarshalledDict)...)
+		rows, err = tx.QueryContext(ctx, query, vals2nameds(params.UnmarshalledDict)...)
 	} else {
-		rows, err = tx.Query(query, params.UnmarshalledArray...)
+		rows, err = tx.QueryContext(ctx, query, params.UnmarshalledArray...)
 	}
 	if err != nil {
 		return nil, err
@@ -83,29 +141,57 @@ func processWithResultSet(tx *sql.Tx, query string, isListResultSet bool, params
 	defer rows.Close()
 
 	headers, _ := rows.Columns() // I can ignore the error, rows aren't closed
+	if stream != nil {
+		if err = stream.writeHeaders(headers); err != nil {
+			return nil, err
+		}
+	}
+
+	var resultTypes []resultType
+	if opts.withTypes {
+		if resultTypes, err = newResultTypes(rows); err != nil {
+			return nil, err
+		}
+	}
+
+	numRows := 0
+	truncated := false
 	for rows.Next() {
-		values := make([]interface{}, len(headers)) // values of the various fields
-		scans := make([]interface{}, len(headers))  // pointers to the values, to pass to Scan()
-		for i := range values {
-			scans[i] = &values[i]
+		if opts.maxRows > 0 && numRows == opts.maxRows {
+			// There's one row more than allowed
+			if opts.failOnLimit {
+				return nil, fmt.Errorf("%w: more than %d", errTooManyRows, opts.maxRows)
+			}
+			truncated = true
+			break
 		}
-		if err = rows.Scan(scans...); err != nil {
+		numRows++
+
+		if opts.withTypes {
+			if err = addStorageClasses(rows, resultTypes); err != nil {
+				return nil, err
+			}
+		}
+
+		values, err := scanRow(rows, len(headers), opts)
+		if err != nil {
 			return nil, err
 		}
 
-		if isListResultSet {
+		if stream != nil {
+			// Streamed, not accumulated
+
+			if err = stream.writeRow(values); err != nil {
+				return nil, err
+			}
+		} else if opts.isList {
 			// List-style result set
 
 			resultSetList = append(resultSetList, values)
 		} else {
 			// Map-style result set
 
-			toAdd := orderedmap.New()
-			for i := range values {
-				toAdd.Set(headers[i], values[i])
-			}
-
-			resultSet = append(resultSet, *toAdd)
+			resultSet = append(resultSet, row2map(headers, values))
 		}
 	}
 
@@ -113,22 +199,223 @@ func processWithResultSet(tx *sql.Tx, query string, isListResultSet bool, params
 		return nil, err
 	}
 
-	if isListResultSet {
-		return &responseItem{true, nil, nil, headers, nil, resultSetList, ""}, nil
+	ret := &responseItem{Success: true, ResultHeaders: headers, ResultTypes: resultTypes, Truncated: truncated}
+	if stream != nil {
+		return ret, nil
+	}
+	if opts.isList {
+		ret.ResultSetList = resultSetList
+	} else {
+		ret.ResultSet = resultSet
+	}
+	return ret, nil
+}
+
+func newResultSetOpts(body *request) resultSetOpts {
+	ret := resultSetOpts{
+		// CSV is built from a list-style result set
+		isList: body.ResultFormat != nil &&
+			(strings.EqualFold(*body.ResultFormat, resultFormatList) || strings.EqualFold(*body.ResultFormat, resultFormatCSV)),
+		withTypes: body.ResultTypes,
+		isCSV:     body.ResultFormat != nil && strings.EqualFold(*body.ResultFormat, resultFormatCSV),
+	}
+	if body.BlobFormat != nil {
+		ret.blobFormat = strings.ToLower(*body.BlobFormat)
+	}
+	return ret
+}
+
+// Scans the current row, converting the values as needed
+func scanRow(rows *sql.Rows, numCols int, opts resultSetOpts) ([]interface{}, error) {
+	values := make([]interface{}, numCols) // values of the various fields
+	scans := make([]interface{}, numCols)  // pointers to the values, to pass to Scan()
+	for i := range values {
+		scans[i] = &values[i]
+	}
+	if err := rows.Scan(scans...); err != nil {
+		return nil, err
+	}
+
+	for i := range values {
+		if bs, ok := values[i].([]byte); ok {
+			values[i] = encodeBlob(bs, opts.blobFormat)
+		}
+	}
+	return values, nil
+}
+
+func row2map(headers []string, values []interface{}) orderedmap.OrderedMap {
+	ret := orderedmap.New()
+	for i := range values {
+		ret.Set(headers[i], values[i])
+	}
+	return *ret
+}
+
+// Builds the type information for the columns of a result set, from what
+// the driver reports. The storage classes are filled in while scanning.
+func newResultTypes(rows *sql.Rows) ([]resultType, error) {
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]resultType, len(colTypes))
+	for i := range colTypes {
+		ret[i].DeclaredType = colTypes[i].DatabaseTypeName()
+		if nullable, ok := colTypes[i].Nullable(); ok {
+			ret[i].Nullable = &nullable
+		}
+		ret[i].StorageClasses = []string{}
+	}
+	return ret, nil
+}
+
+// SQLite is dynamically typed, so the storage class is a property of each
+// value, not of the column. After a call to Next(), the driver reports the
+// scan type of the current row, so it's mapped back to the storage class
+// and, if not yet seen for the column, added to the list.
+func addStorageClasses(rows *sql.Rows, resultTypes []resultType) error {
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+
+	for i := range colTypes {
+		sc := storageClass(colTypes[i].ScanType())
+		if !slices.Contains(resultTypes[i].StorageClasses, sc) {
+			resultTypes[i].StorageClasses = append(resultTypes[i].StorageClasses, sc)
+		}
+	}
+	return nil
+}
+
+func storageClass(scanType reflect.Type) string {
+	if scanType == nil {
+		return "NULL"
+	}
+	switch scanType.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return "REAL"
+	case reflect.String:
+		return "TEXT"
+	case reflect.Slice:
+		return "BLOB"
+	default:
+		// integers, but also booleans and timestamps, that the driver
+		// converts from integers when the declared type says so
+		return "INTEGER"
+	}
+}
+
+// Returns the plan of a query or statement, without executing it
+func explainQuery(ctx context.Context, tx dbTx, query string, params requestParams) (*responseItem, error) {
+	var rows *sql.Rows
+	var err error
+	if params.UnmarshalledDict != nil {
+		rows, err = tx.QueryContext(ctx, "EXPLAIN QUERY PLAN "+query, vals2nameds(params.UnmarshalledDict)...)
+	} else {
+		rows, err = tx.QueryContext(ctx, "EXPLAIN QUERY PLAN "+query, params.UnmarshalledArray...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plan := []queryPlanRow{}
+	for rows.Next() {
+		var row queryPlanRow
+		var notUsed int
+		if err := rows.Scan(&row.Id, &row.Parent, &notUsed, &row.Detail); err != nil {
+			return nil, err
+		}
+		plan = append(plan, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &responseItem{Success: true, QueryPlan: plan}, nil
+}
+
+// Executes the query of a precondition, and tells if it's met: the first column
+// of the first row must be "truthy", i.e. not NULL, zero, false or an empty
+// string (or BLOB). No rows at all means that it's not met.
+func checkPrecondition(ctx context.Context, tx dbTx, query string, params requestParams) (bool, error) {
+	row := (*sql.Row)(nil)
+	if params.UnmarshalledDict != nil {
+		row = tx.QueryRowContext(ctx, query, vals2nameds(params.UnmarshalledDict)...)
+	} else {
+		row = tx.QueryRowContext(ctx, query, params.UnmarshalledArray...)
+	}
+
+	var value interface{}
+	if err := row.Scan(&value); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return false, nil
+	case int64:
+		return v != 0, nil
+	case float64:
+		return v != 0, nil
+	case bool:
+		return v, nil
+	case string:
+		return v != "", nil
+	case []byte:
+		return len(v) > 0, nil
+	default:
+		return true, nil
 	}
-	return &responseItem{true, nil, nil, headers, resultSet, nil, ""}, nil
+}
+
+var returningRegexp = regexp.MustCompile(`(?i)\bRETURNING\b`)
+
+// Does the statement have a RETURNING clause? It's a crude check (it could
+// match inside a string literal) but the consequences of a false positive
+// are only that the response has an empty result set.
+func hasReturning(statement string) bool {
+	return returningRegexp.MatchString(statement)
+}
+
+// Process a statement with a RETURNING clause: it's executed as a query, then
+// the number of changes and the last inserted id are asked to SQLite, as
+// they would be returned by Exec().
+func processWithReturning(ctx context.Context, tx dbTx, statement string, opts resultSetOpts, params requestParams) (*responseItem, error) {
+	ret, err := processWithResultSet(ctx, tx, statement, opts, params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var rowsUpdated, lastInsertId int64
+	if err = tx.QueryRowContext(ctx, "SELECT changes(), last_insert_rowid()").Scan(&rowsUpdated, &lastInsertId); err != nil {
+		return nil, err
+	}
+
+	ret.RowsUpdated = &rowsUpdated
+	ret.LastInsertId = &lastInsertId
+	return ret, nil
 }
 
 // Process a single statement, and returns a suitable responseItem
-func processForExec(tx *sql.Tx, statement string, params requestParams) (*responseItem, error) {
+func processForExec(ctx context.Context, tx dbTx, statement string, opts resultSetOpts, params requestParams) (*responseItem, error) {
+	if hasReturning(statement) {
+		return processWithReturning(ctx, tx, statement, opts, params)
+	}
+
 	res := (sql.Result)(nil)
 	err := (error)(nil)
 	if params.UnmarshalledDict == nil && params.UnmarshalledArray == nil {
 		res, err = nil, errors.New("processWithResultSet unreachable code")
 	} else if params.UnmarshalledDict != nil {
-		res, err = tx.Exec(statement, vals2nameds(params.UnmarshalledDict)...)
+		res, err = tx.ExecContext(ctx, statement, vals2nameds(params.UnmarshalledDict)...)
 	} else {
-		res, err = tx.Exec(statement, params.UnmarshalledArray...)
+		res, err = tx.ExecContext(ctx, statement, params.UnmarshalledArray...)
 	}
 	if err != nil {
 		return nil, err
@@ -139,28 +426,39 @@ func processForExec(tx *sql.Tx, statement string, params requestParams) (*respon
 		return nil, err
 	}
 
-	return &responseItem{true, &rowsUpdated, nil, nil, nil, nil, ""}, nil
+	lastInsertId, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &responseItem{Success: true, RowsUpdated: &rowsUpdated, LastInsertId: &lastInsertId}, nil
 }
 
 // Process a batch statement, and returns a suitable responseItem.
 // It prepares the statement, then executes it for each of the values' sets.
-func processForExecBatch(tx *sql.Tx, q string, paramsBatch []requestParams) (*responseItem, error) {
-	ps, err := tx.Prepare(q)
+//
+// With a RETURNING clause, there's a result set for each of the values' sets.
+func processForExecBatch(ctx context.Context, tx dbTx, q string, opts resultSetOpts, paramsBatch []requestParams) (*responseItem, error) {
+	ps, err := tx.PrepareContext(ctx, q)
 	if err != nil {
 		return nil, err
 	}
 	defer ps.Close()
 
-	var rowsUpdatedBatch []int64
+	if hasReturning(q) {
+		return processWithReturningBatch(ctx, tx, q, opts, paramsBatch)
+	}
+
+	var rowsUpdatedBatch, lastInsertIdBatch []int64
 	for _, params := range paramsBatch {
 		res := (sql.Result)(nil)
 		err := (error)(nil)
 		if params.UnmarshalledDict == nil && params.UnmarshalledArray == nil {
 			res, err = nil, errors.New("processWithResultSet unreachable code")
 		} else if params.UnmarshalledDict != nil {
-			res, err = tx.Exec(q, vals2nameds(params.UnmarshalledDict)...)
+			res, err = tx.ExecContext(ctx, q, vals2nameds(params.UnmarshalledDict)...)
 		} else {
-			res, err = tx.Exec(q, params.UnmarshalledArray...)
+			res, err = tx.ExecContext(ctx, q, params.UnmarshalledArray...)
 		}
 		if err != nil {
 			return nil, err
@@ -171,10 +469,56 @@ func processForExecBatch(tx *sql.Tx, q string, paramsBatch []requestParams) (*re
 			return nil, err
 		}
 
+		lastInsertId, err := res.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+
 		rowsUpdatedBatch = append(rowsUpdatedBatch, rowsUpdated)
+		lastInsertIdBatch = append(lastInsertIdBatch, lastInsertId)
 	}
 
-	return &responseItem{true, nil, rowsUpdatedBatch, nil, nil, nil, ""}, nil
+	return &responseItem{Success: true, RowsUpdatedBatch: rowsUpdatedBatch, LastInsertIdBatch: lastInsertIdBatch}, nil
+}
+
+func processWithReturningBatch(ctx context.Context, tx dbTx, q string, opts resultSetOpts, paramsBatch []requestParams) (*responseItem, error) {
+	ret := &responseItem{Success: true}
+	if opts.isList {
+		ret.ResultSetListBatch = make([][][]interface{}, 0, len(paramsBatch))
+	} else {
+		ret.ResultSetBatch = make([][]orderedmap.OrderedMap, 0, len(paramsBatch))
+	}
+
+	for _, params := range paramsBatch {
+		retR, err := processWithReturning(ctx, tx, q, opts, params)
+		if err != nil {
+			return nil, err
+		}
+
+		ret.RowsUpdatedBatch = append(ret.RowsUpdatedBatch, *retR.RowsUpdated)
+		ret.LastInsertIdBatch = append(ret.LastInsertIdBatch, *retR.LastInsertId)
+		ret.ResultHeaders = retR.ResultHeaders
+		if opts.isList {
+			ret.ResultSetListBatch = append(ret.ResultSetListBatch, retR.ResultSetList)
+		} else {
+			ret.ResultSetBatch = append(ret.ResultSetBatch, retR.ResultSet)
+		}
+
+		// The types are the union of the ones of the single sets
+		if ret.ResultTypes == nil {
+			ret.ResultTypes = retR.ResultTypes
+		} else {
+			for i := range retR.ResultTypes {
+				for _, sc := range retR.ResultTypes[i].StorageClasses {
+					if !slices.Contains(ret.ResultTypes[i].StorageClasses, sc) {
+						ret.ResultTypes[i].StorageClasses = append(ret.ResultTypes[i].StorageClasses, sc)
+					}
+				}
+			}
+		}
+	}
+
+	return ret, nil
 }
 
 func ckSQL(sql string) string {
@@ -190,174 +534,685 @@ func ckSQL(sql string) string {
 	return ""
 }
 
-// Handler for the POST. Receives the body of the HTTP request, parses it
-// and executes the transaction on the database retrieved from the URL path.
-// Constructs and sends the response.
-func handler(databaseId string) func(c *fiber.Ctx) error {
-	return func(c *fiber.Ctx) error {
-		var body request
-		if err := c.BodyParser(&body); err != nil {
-			return newWSErrorf(-1, fiber.StatusBadRequest, "in parsing body: %s", err.Error())
+// Returns the context for a request, that expires after the timeout configured
+// for the database, if any.
+func newRequestContext(db *db) (context.Context, context.CancelFunc) {
+	if db.TimeoutMillis > 0 {
+		return context.WithTimeout(context.Background(), time.Duration(db.TimeoutMillis)*time.Millisecond)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// Returns the context for an item, that can specify a timeout. It's derived
+// from the one of the request, so it can only be shorter than the latter.
+func newItemContext(ctx context.Context, timeoutMillis int) (context.Context, context.CancelFunc) {
+	if timeoutMillis > 0 {
+		return context.WithTimeout(ctx, time.Duration(timeoutMillis)*time.Millisecond)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Reports an error in executing an item. If it's because the time ran out,
+// or the database is busy, the request fails anyway, with a specific error;
+// the execution was interrupted and the transaction will be rolled back.
+func reportExecError(ctx context.Context, err error, reqIdx int, noFail bool, results []responseItem) {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		panic(newWSError(reqIdx, fiber.StatusGatewayTimeout, errTimeout))
+	}
+	if isBusy(err) {
+		panic(newWSError(reqIdx, fiber.StatusServiceUnavailable, err.Error()))
+	}
+	if errors.Is(err, errTooManyRows) {
+		reportError(err, fiber.StatusBadRequest, reqIdx, noFail, results)
+		return
+	}
+	reportError(err, fiber.StatusInternalServerError, reqIdx, noFail, results)
+}
+
+// Commits a transaction. It may fail because the timeout expired just before,
+// and the transaction was rolled back. If the database has a change feed, the
+// changes made in the transaction are published.
+func commitTx(ctx context.Context, db *db, tx dbTx) error {
+	var changes []changeEvent
+	if db.ChangeFeed != nil {
+		var err error
+		if changes, err = db.ChangeFeed.collect(ctx, tx); err != nil {
+			return newWSError(-1, fiber.StatusInternalServerError, err.Error())
 		}
+	}
 
-		isListResultSet := body.ResultFormat != nil && strings.EqualFold(*body.ResultFormat, "list")
+	if err := tx.Commit(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return newWSError(-1, fiber.StatusGatewayTimeout, errTimeout)
+		}
+		if isBusy(err) {
+			// database/sql considers the transaction done, but SQLite keeps
+			// it open on the connection; a connTx already rolled it back.
+			if _, ok := tx.(*sql.Tx); ok {
+				db.DbConn.ExecContext(context.Background(), "ROLLBACK")
+			}
+			return newWSError(-1, fiber.StatusServiceUnavailable, err.Error())
+		}
+		return newWSError(-1, fiber.StatusInternalServerError, err.Error())
+	}
 
-		// Fix for Issue #57: URL-decode the database ID parameter.
-		// The databaseId parameter is the URL-encoded form passed from the route registration
-		// (e.g., "%E6%95%B0%E6%8D%AE%E5%BA%93"). We decode it to get the human-readable ID
-		// (e.g., "数据库") to look it up in the dbs map which stores human-readable IDs.
-		// The parameter comes in URL-encoded (e.g., "%E6%95%B0%E6%8D%AE%E5%BA%93")
-		// and must be decoded to match the human-readable ID stored in the
-		// dbs map (e.g., "数据库").
-		databaseId, err := url.PathUnescape(databaseId)
-		if err != nil {
-			return newWSErrorf(-1, fiber.StatusBadRequest, "invalid URL path encoding: %s", err.Error())
+	if db.ChangeFeed != nil {
+		db.ChangeFeed.publish(changes)
+		// The transaction may have created some tables
+		if err := db.ChangeFeed.syncTriggers(db.DbConn); err != nil {
+			mllog.Errorf("in creating the change triggers of '%s': %s", db.Id, err.Error())
 		}
+	}
+	return nil
+}
+
+// Computes the maximum number of rows that an item can return, and whether
+// exceeding it is an error rather than a truncation. The limit of the item
+// can only be lower than the one of the database. A CSV can't tell that it
+// was truncated, so for it exceeding the limit of the database is an error.
+func rowLimit(db *db, txItem requestItem, isCSV bool) (int, bool) {
+	if db.MaxRows > 0 && (txItem.Limit == 0 || txItem.Limit > db.MaxRows) {
+		return db.MaxRows, db.FailOnMaxRows || isCSV
+	}
+	return txItem.Limit, false
+}
 
-		db, found := dbs[databaseId]
-		if !found {
-			return newWSErrorf(-1, fiber.StatusNotFound, "database with ID '%s' not found", databaseId)
+// Checks the SQL of an item, and if it refers to a stored statement ('#' + ID)
+// returns the actual SQL of the latter.
+func resolveSQL(db *db, sqll string) (string, error) {
+	// Sanitize: BEGIN, COMMIT and ROLLBACK aren't allowed
+	if errStr := ckSQL(sqll); errStr != "" {
+		return "", errors.New("errStr")
+	}
+
+	// Processes a stored statement
+	if strings.HasPrefix(sqll, "#") {
+		ret, ok := db.StoredStatsMap[sqll[1:]]
+		if !ok {
+			return "", errors.New("a stored statement is required, but did not find it")
 		}
+		return ret, nil
+	}
 
-		// Execute non-concurrently
-		db.Mutex.Lock()
-		defer db.Mutex.Unlock()
+	if db.UseOnlyStoredStatements {
+		return "", errors.New("configured to serve only stored statements, but SQL is passed")
+	}
+	return sqll, nil
+}
 
-		if db.Auth != nil && strings.ToUpper(db.Auth.Mode) == authModeInline {
-			if err := applyAuth(&db, &body); err != nil {
-				// When unauthenticated waits for 1s to hinder brute force attacks
-				time.Sleep(time.Second)
-				if db.Auth.CustomErrorCode != nil {
-					return newWSError(-1, *db.Auth.CustomErrorCode, err.Error())
-				}
-				return newWSError(-1, fiber.StatusUnauthorized, err.Error())
+// Executes the items of a request in the given transaction, and returns the
+// results. Failures that invalidate the whole transaction are raised as panics
+// (see reportError), so the caller must roll back when it's the case.
+//
+// If stream is not nil, the rows of the queries are written to it as they are
+// read, and are not accumulated in the results.
+func processItems(ctx context.Context, db *db, tx dbTx, body *request, stream *ndjsonStream) []responseItem {
+	opts := newResultSetOpts(body)
+
+	results := make([]responseItem, len(body.Transaction))
+
+	for i := range body.Transaction {
+		start := time.Now()
+		if body.Transaction[i].NoFail {
+			processItemInSavepoint(ctx, db, tx, body.Transaction[i], i, opts, results, stream)
+		} else {
+			processItem(ctx, db, tx, body.Transaction[i], i, opts, results, stream)
+		}
+		results[i].elapsed = time.Since(start)
+	}
+
+	return results
+}
+
+// Executes a noFail item in a savepoint, that is rolled back if the item
+// fails; so the item is either fully applied, or leaves no trace in the
+// transaction. If the savepoint cannot be managed, the transaction fails.
+func processItemInSavepoint(ctx context.Context, db *db, tx dbTx, txItem requestItem, i int, opts resultSetOpts, results []responseItem, stream *ndjsonStream) {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT "+noFailSavepoint); err != nil {
+		reportExecError(ctx, err, i, false, results)
+		return
+	}
+
+	processItem(ctx, db, tx, txItem, i, opts, results, stream)
+
+	if !results[i].Success {
+		if _, err := tx.ExecContext(ctx, "ROLLBACK TO "+noFailSavepoint); err != nil {
+			reportExecError(ctx, err, i, false, results)
+			return
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "RELEASE "+noFailSavepoint); err != nil {
+		reportExecError(ctx, err, i, false, results)
+	}
+}
+
+// Executes an item of a transaction, putting the outcome in results[i]. If the
+// item fails and it's not noFail, it panics (see reportError()).
+func processItem(ctx context.Context, db *db, tx dbTx, txItem requestItem, i int, opts resultSetOpts, results []responseItem, stream *ndjsonStream) {
+	if txItem.TimeoutMillis < 0 {
+		reportError(errors.New("timeoutMillis cannot be negative"), fiber.StatusBadRequest, i, txItem.NoFail, results)
+		return
+	}
+
+	if txItem.Limit < 0 {
+		reportError(errors.New("limit cannot be negative"), fiber.StatusBadRequest, i, txItem.NoFail, results)
+		return
+	}
+
+	itemOpts := opts
+	itemOpts.maxRows, itemOpts.failOnLimit = rowLimit(db, txItem, opts.isCSV)
+
+	// Each item is executed with its own context, that may have a shorter
+	// timeout than the request
+	itemCtx, cancelItem := newItemContext(ctx, txItem.TimeoutMillis)
+	defer cancelItem()
+
+	if countNonEmpty(txItem.Query, txItem.Statement, txItem.Precondition) != 1 {
+		reportError(errors.New("one and only one of query, statement or precondition must be provided"), fiber.StatusBadRequest, i, txItem.NoFail, results)
+		return
+	}
+
+	if txItem.PageSize != 0 {
+		reportError(errors.New("pageSize is only allowed in a request with a single query"), fiber.StatusBadRequest, i, txItem.NoFail, results)
+		return
+	}
+
+	hasResultSet := txItem.Query != ""
+	isPrecondition := txItem.Precondition != ""
+
+	if isPrecondition && txItem.NoFail {
+		reportError(errors.New("a precondition cannot be noFail"), fiber.StatusBadRequest, i, false, results)
+		return
+	}
+
+	if txItem.Explain && (isPrecondition || len(txItem.ValuesBatch) > 0) {
+		reportError(errors.New("explain is only allowed for queries and statements without valuesBatch"), fiber.StatusBadRequest, i, txItem.NoFail, results)
+		return
+	}
+
+	if !isEmptyRaw(txItem.Values) && len(txItem.ValuesBatch) != 0 {
+		reportError(errors.New("cannot specify both values and valuesBatch"), fiber.StatusBadRequest, i, txItem.NoFail, results)
+		return
+	}
+
+	if (hasResultSet || isPrecondition) && len(txItem.ValuesBatch) > 0 {
+		reportError(errors.New("cannot specify valuesBatch for queries or preconditions (only for statements)"), fiber.StatusBadRequest, i, txItem.NoFail, results)
+		return
+	}
+
+	var sqll string
+
+	if hasResultSet {
+		sqll = txItem.Query
+	} else if isPrecondition {
+		sqll = txItem.Precondition
+	} else {
+		sqll = txItem.Statement
+	}
+
+	sqll, err := resolveSQL(db, sqll)
+	if err != nil {
+		reportError(err, fiber.StatusBadRequest, i, txItem.NoFail, results)
+		return
+	}
+
+	if len(txItem.ValuesBatch) > 0 {
+		// Process a batch statement (multiple values)
+		var paramsBatch []requestParams
+		failed := false
+		for i2 := range txItem.ValuesBatch {
+			params, err := raw2params(txItem.ValuesBatch[i2])
+			if err != nil {
+				reportError(err, fiber.StatusInternalServerError, i, txItem.NoFail, results)
+				failed = true
+				break
 			}
+
+			if err := resolveRefs(params, results[:i]); err != nil {
+				reportError(err, fiber.StatusBadRequest, i, txItem.NoFail, results)
+				failed = true
+				break
+			}
+
+			paramsBatch = append(paramsBatch, *params)
+		}
+		if failed {
+			return
 		}
 
-		if len(body.Transaction) == 0 {
-			return newWSError(-1, fiber.StatusBadRequest, "missing statements list ('transaction' node)")
+		retE, err := processForExecBatch(itemCtx, tx, sqll, itemOpts, paramsBatch)
+		if err != nil {
+			reportExecError(itemCtx, err, i, txItem.NoFail, results)
+			return
 		}
 
-		// Opens a transaction. One more occasion to specify: read only ;-)
-		tx, err := db.DbConn.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: db.ReadOnly})
+		results[i] = *retE
+	} else {
+		// At most one values set (be it query or statement)
+		params, err := raw2params(txItem.Values)
 		if err != nil {
-			return newWSError(-1, fiber.StatusInternalServerError, err.Error())
+			reportError(err, fiber.StatusInternalServerError, i, txItem.NoFail, results)
+			return
 		}
 
-		tainted := true // If I reach the end of the method, I switch this to false to signal success
-		defer func() {
-			if tainted {
-				tx.Rollback()
-			} else {
-				tx.Commit()
+		if err := resolveRefs(params, results[:i]); err != nil {
+			reportError(err, fiber.StatusBadRequest, i, txItem.NoFail, results)
+			return
+		}
+
+		if txItem.Explain {
+			// The item is not executed, only its plan is returned
+			retE, err := explainQuery(itemCtx, tx, sqll, *params)
+			if err != nil {
+				reportExecError(itemCtx, err, i, txItem.NoFail, results)
+				return
 			}
-		}()
 
-		var ret response
-		ret.Results = make([]responseItem, len(body.Transaction))
+			results[i] = *retE
+		} else if isPrecondition {
+			// Precondition: if not met, the transaction is aborted
+			ok, err := checkPrecondition(itemCtx, tx, sqll, *params)
+			if err != nil {
+				reportExecError(itemCtx, err, i, false, results)
+				return
+			}
+			if !ok {
+				reportError(errors.New("precondition not met"), fiber.StatusPreconditionFailed, i, false, results)
+				return
+			}
 
-		for i := range body.Transaction {
-			txItem := body.Transaction[i]
+			results[i] = responseItem{Success: true}
+		} else if hasResultSet {
+			// Query
+			// Externalized in a func so that defer rows.Close() actually runs
+			if stream != nil {
+				stream.reqIdx = i
+			}
+			retWR, err := processWithResultSet(itemCtx, tx, sqll, itemOpts, *params, stream)
+			if err != nil {
+				reportExecError(itemCtx, err, i, txItem.NoFail, results)
+				return
+			}
 
-			if (txItem.Query == "") == (txItem.Statement == "") {
-				reportError(errors.New("one and only one of query or statement must be provided"), fiber.StatusBadRequest, i, txItem.NoFail, ret.Results)
-				continue
+			results[i] = *retWR
+		} else {
+			// Statement
+			retE, err := processForExec(itemCtx, tx, sqll, itemOpts, *params)
+			if err != nil {
+				reportExecError(itemCtx, err, i, txItem.NoFail, results)
+				return
 			}
 
-			hasResultSet := txItem.Query != ""
+			results[i] = *retE
+		}
+	}
+}
+
+// Waits for the database to be free, and locks it. If it's held by an
+// interactive transaction, that can last long, fails at once with a 409. A
+// request that was already waiting when the transaction began waits for it
+// to end, within its maximum lifetime.
+func lockDb(db *db) error {
+	if hasInteractiveTx(db) {
+		return newWSError(-1, fiber.StatusConflict, "the database is held by an interactive transaction")
+	}
+	db.Mutex.Lock()
+	return nil
+}
 
-			if !isEmptyRaw(txItem.Values) && len(txItem.ValuesBatch) != 0 {
-				reportError(errors.New("cannot specify both values and valuesBatch"), fiber.StatusBadRequest, i, txItem.NoFail, ret.Results)
-				continue
+// Looks up a database, given its ID as it comes from the route registration.
+//
+// Fix for Issue #57: URL-decode the database ID parameter.
+// The databaseId parameter is the URL-encoded form passed from the route registration
+// (e.g., "%E6%95%B0%E6%8D%AE%E5%BA%93"). We decode it to get the human-readable ID
+// (e.g., "数据库") to look it up in the dbs map which stores human-readable IDs.
+// The parameter comes in URL-encoded (e.g., "%E6%95%B0%E6%8D%AE%E5%BA%93")
+// and must be decoded to match the human-readable ID stored in the
+// dbs map (e.g., "数据库").
+func lookupDb(databaseId string) (db, error) {
+	databaseId, err := url.PathUnescape(databaseId)
+	if err != nil {
+		return db{}, newWSErrorf(-1, fiber.StatusBadRequest, "invalid URL path encoding: %s", err.Error())
+	}
+
+	db, found := dbs[databaseId]
+	if !found {
+		return db, newWSErrorf(-1, fiber.StatusNotFound, "database with ID '%s' not found", databaseId)
+	}
+	return db, nil
+}
+
+// If the database is configured for INLINE authentication, checks the credentials
+// in the request. The caller should hold the mutex of the database, so that the
+// wait after a failure serializes the attempts.
+func ckInlineAuth(db *db, body *request) error {
+	if db.Auth != nil && strings.ToUpper(db.Auth.Mode) == authModeInline {
+		if err := applyAuth(db, body); err != nil {
+			// When unauthenticated waits for 1s to hinder brute force attacks
+			time.Sleep(time.Second)
+			if db.Auth.CustomErrorCode != nil {
+				return newWSError(-1, *db.Auth.CustomErrorCode, err.Error())
 			}
+			return newWSError(-1, fiber.StatusUnauthorized, err.Error())
+		}
+	}
+	return nil
+}
 
-			if hasResultSet && len(txItem.ValuesBatch) > 0 {
-				reportError(errors.New("cannot specify valuesBatch for queries (only for statements)"), fiber.StatusBadRequest, i, txItem.NoFail, ret.Results)
-				continue
+// For INLINE auth, the endpoints that are called with GET accept the
+// credentials in the Authorization header, as HTTP Basic auth.
+func ckInlineAuthHeader(db *db, c *fiber.Ctx) error {
+	var body request
+	if auth, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Basic "); found {
+		if bs, err := base64.StdEncoding.DecodeString(auth); err == nil {
+			if user, password, found := strings.Cut(string(bs), ":"); found {
+				body.Credentials = &credentials{User: user, Password: password}
 			}
+		}
+	}
+	return ckInlineAuth(db, &body)
+}
 
-			var sqll string
+// Checks the request-level options, that are not about the single items
+func ckRequestOptions(body *request) error {
+	if body.Version < 0 || body.Version > protocolV2 {
+		return newWSErrorf(-1, fiber.StatusBadRequest, "unsupported protocol version %d", body.Version)
+	}
+	txMode, err := parseTxMode(body.TxMode)
+	if err != nil {
+		return newWSError(-1, fiber.StatusBadRequest, err.Error())
+	}
+	body.TxMode = txMode
+	if body.BlobFormat != nil {
+		switch strings.ToLower(*body.BlobFormat) {
+		case blobFormatBase64, blobFormatHex, blobFormatTagged:
+		default:
+			return newWSErrorf(-1, fiber.StatusBadRequest, "unknown blob format '%s'", *body.BlobFormat)
+		}
+	}
+	return nil
+}
 
-			if hasResultSet {
-				sqll = txItem.Query
+// Calls processItems(), converting a panic (that signals a failure of the
+// transaction) into an error. To be used where the recover middleware can't
+// intervene, or where the failure needs to be managed; every panic must be
+// caught here, or in a goroutine it would bring down the server.
+func processItemsRecovering(ctx context.Context, db *db, tx dbTx, body *request, stream *ndjsonStream) (results []responseItem, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if wse, ok := r.(wsError); ok {
+				err = wse
 			} else {
-				sqll = txItem.Statement
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+
+	return processItems(ctx, db, tx, body, stream), nil
+}
+
+// Executes the items of a request in a transaction, that is committed unless
+// it's a dry run. If beforeCommit is not nil, it's called just before the
+// commit, and its failure rolls back the transaction. If the database is busy,
+// the transaction is retried (see retryOnBusy()). The caller must hold the
+// mutex of the database.
+func runTransaction(db *db, body *request, beforeCommit func(context.Context, dbTx, []responseItem) error) ([]responseItem, error) {
+	// If the timeout expires, the running statement is interrupted and the
+	// transaction is rolled back. It's for all the attempts.
+	ctx, cancel := newRequestContext(db)
+	defer cancel()
+
+	var results []responseItem
+	err := retryOnBusy(ctx, db, func() error {
+		var err error
+		results, err = runTransactionOnce(ctx, db, body, beforeCommit)
+		return err
+	})
+	return results, err
+}
+
+// An attempt of runTransaction()
+func runTransactionOnce(ctx context.Context, db *db, body *request, beforeCommit func(context.Context, dbTx, []responseItem) error) ([]responseItem, error) {
+	// Opens a transaction. One more occasion to specify: read only ;-)
+	tx, err := startTx(ctx, db, body.TxMode, db.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := processItemsRecovering(ctx, db, tx, body, nil)
+	if err != nil || body.DryRun {
+		tx.Rollback()
+		return results, err
+	}
+
+	if beforeCommit != nil {
+		if err := beforeCommit(ctx, tx, results); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if err := commitTx(ctx, db, tx); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// Checks a request, before executing it: authentication and options
+func ckRequest(db *db, body *request) error {
+	if err := ckInlineAuth(db, body); err != nil {
+		return err
+	}
+
+	if len(body.Transaction) == 0 {
+		return newWSError(-1, fiber.StatusBadRequest, "missing statements list ('transaction' node)")
+	}
+
+	return ckRequestOptions(body)
+}
+
+// Handler for the POST. Receives the body of the HTTP request, parses it
+// and executes the transaction on the database retrieved from the URL path.
+// Constructs and sends the response, in the version of the protocol that
+// the request specifies.
+func handler(databaseId string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		var body request
+		if err := parseBody(c, &body); err != nil {
+			return newWSErrorf(-1, fiber.StatusBadRequest, "in parsing body: %s", err.Error())
+		}
+
+		db, err := lookupDb(databaseId)
+		if err != nil {
+			return err
+		}
+
+		// Execute non-concurrently
+		if err := lockDb(&db); err != nil {
+			return err
+		}
+		defer db.Mutex.Unlock()
+
+		if body.Version == protocolV2 {
+			return handleV2(c, &db, &body)
+		}
+
+		if err := ckRequest(&db, &body); err != nil {
+			return err
+		}
+
+		idem, err := newIdempotentRequest(c, &db, &body)
+		if err != nil {
+			return err
+		}
+		if idem != nil {
+			recorded, err := idem.lookup(&db)
+			if err != nil {
+				return err
+			}
+			if recorded != nil {
+				return sendReplayed(c, recorded)
 			}
+		}
 
-			// Sanitize: BEGIN, COMMIT and ROLLBACK aren't allowed
-			if errStr := ckSQL(sqll); errStr != "" {
-				reportError(errors.New("errStr"), fiber.StatusBadRequest, i, txItem.NoFail, ret.Results)
-				continue
+		if body.Transaction[0].PageSize != 0 {
+			// The query is served by a cursor, outside the main connection
+			if err := ckCursorRequest(&db, &body); err != nil {
+				return err
 			}
 
-			// Processes a stored statement
-			if strings.HasPrefix(sqll, "#") {
-				var ok bool
-				sqll, ok = db.StoredStatsMap[sqll[1:]]
-				if !ok {
-					reportError(errors.New("a stored statement is required, but did not find it"), fiber.StatusBadRequest, i, txItem.NoFail, ret.Results)
-					continue
-				}
-			} else {
-				if db.UseOnlyStoredStatements {
-					reportError(errors.New("configured to serve only stored statements, but SQL is passed"), fiber.StatusBadRequest, i, txItem.NoFail, ret.Results)
-					continue
-				}
+			item, err := openCursor(&db, &body)
+			if err != nil {
+				return err
 			}
 
-			if len(txItem.ValuesBatch) > 0 {
-				// Process a batch statement (multiple values)
-				var paramsBatch []requestParams
-				for i2 := range txItem.ValuesBatch {
-					params, err := raw2params(txItem.ValuesBatch[i2])
-					if err != nil {
-						reportError(err, fiber.StatusInternalServerError, i, txItem.NoFail, ret.Results)
-						continue
-					}
+			return sendResponse(c, 200, response{Results: []responseItem{*item}})
+		}
 
-					paramsBatch = append(paramsBatch, *params)
-				}
+		if body.ResultFormat != nil && strings.EqualFold(*body.ResultFormat, resultFormatNDJSONStream) {
+			// The transaction is executed while the response is written, see streamTransaction()
+			c.Set(fiber.HeaderContentType, "application/x-ndjson")
+			c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+				streamTransaction(&db, &body, w)
+			})
+			return nil
+		}
 
-				retE, err := processForExecBatch(tx, sqll, paramsBatch)
-				if err != nil {
-					reportError(err, fiber.StatusInternalServerError, i, txItem.NoFail, ret.Results)
-					continue
-				}
+		isCSV := body.ResultFormat != nil && strings.EqualFold(*body.ResultFormat, resultFormatCSV)
+		if isCSV {
+			if err := ckCSVRequest(&body); err != nil {
+				return newWSError(-1, fiber.StatusBadRequest, err.Error())
+			}
+		}
 
-				ret.Results[i] = *retE
-			} else {
-				// At most one values set (be it query or statement)
-				params, err := raw2params(txItem.Values)
+		render := func(results []responseItem) (*renderedResponse, error) {
+			if isCSV {
+				csv, err := results2csv(results[0], body.CSVOptions)
 				if err != nil {
-					reportError(err, fiber.StatusInternalServerError, i, txItem.NoFail, ret.Results)
-					continue
+					return nil, newWSError(-1, fiber.StatusInternalServerError, err.Error())
 				}
+				return &renderedResponse{Status: 200, ContentType: csvContentType(body.CSVOptions), Body: csv}, nil
+			}
+			return encodeResponse(c, 200, response{Results: results, DryRun: body.DryRun})
+		}
 
-				if hasResultSet {
-					// Query
-					// Externalized in a func so that defer rows.Close() actually runs
-					retWR, err := processWithResultSet(tx, sqll, isListResultSet, *params)
-					if err != nil {
-						reportError(err, fiber.StatusInternalServerError, i, txItem.NoFail, ret.Results)
-						continue
-					}
+		results, err := runTransaction(&db, &body, idem.recorder(&db, render))
+		if err != nil {
+			return err
+		}
 
-					ret.Results[i] = *retWR
-				} else {
-					// Statement
-					retE, err := processForExec(tx, sqll, *params)
-					if err != nil {
-						reportError(err, fiber.StatusInternalServerError, i, txItem.NoFail, ret.Results)
-						continue
-					}
+		// If the response was recorded, what's sent is exactly what will be replayed
+		if idem != nil && idem.Recorded != nil {
+			return sendRendered(c, idem.Recorded)
+		}
 
-					ret.Results[i] = *retE
-				}
+		resp, err := render(results)
+		if err != nil {
+			return err
+		}
+		return sendRendered(c, resp)
+	}
+}
+
+func newErrorV2(code int, msg string, reqIdx int) *errorV2 {
+	ret := errorV2{Type: errorTypes[code], Message: capitalize(msg)}
+	if ret.Type == "" {
+		ret.Type = "ERROR" // e.g. a custom error code for the authentication
+	}
+	if reqIdx >= 0 {
+		ret.RequestIdx = &reqIdx
+	}
+	return &ret
+}
+
+// Serves a request in version 2 of the protocol: all the outcomes, errors
+// included, are in a responseV2. The streaming and CSV formats are not
+// supported. The caller must hold the mutex of the database.
+func handleV2(c *fiber.Ctx, db *db, body *request) error {
+	start := time.Now()
+
+	var idem *idempotentRequest
+	var replayed *renderedResponse
+	results, err := func() ([]responseItem, error) {
+		if err := ckRequest(db, body); err != nil {
+			return nil, err
+		}
+
+		if body.ResultFormat != nil &&
+			(strings.EqualFold(*body.ResultFormat, resultFormatNDJSONStream) || strings.EqualFold(*body.ResultFormat, resultFormatCSV)) {
+			return nil, newWSErrorf(-1, fiber.StatusBadRequest, "result format '%s' is not supported in version 2 of the protocol", *body.ResultFormat)
+		}
+
+		var err error
+		if idem, err = newIdempotentRequest(c, db, body); err != nil {
+			return nil, err
+		}
+		if idem != nil {
+			if replayed, err = idem.lookup(db); err != nil || replayed != nil {
+				return nil, err
+			}
+		}
+
+		if body.Transaction[0].PageSize != 0 {
+			if err := ckCursorRequest(db, body); err != nil {
+				return nil, err
 			}
+
+			item, err := openCursor(db, body)
+			if err != nil {
+				return nil, err
+			}
+			return []responseItem{*item}, nil
+		}
+
+		return runTransaction(db, body, idem.recorder(db, func(results []responseItem) (*renderedResponse, error) {
+			return encodeResponse(c, 200, newResponseV2(db, body, start, results))
+		}))
+	}()
+
+	if replayed != nil {
+		return sendReplayed(c, replayed)
+	}
+
+	if err != nil {
+		wse, ok := err.(wsError)
+		if !ok {
+			wse = newWSError(-1, fiber.StatusInternalServerError, err.Error())
 		}
+		ret := newResponseV2(db, body, start, nil)
+		ret.Error = newErrorV2(wse.Code, wse.Msg, wse.RequestIdx)
+		return sendResponse(c, wse.Code, ret)
+	}
 
-		tainted = false
+	if idem != nil && idem.Recorded != nil {
+		return sendRendered(c, idem.Recorded)
+	}
 
-		return c.Status(200).JSON(ret)
+	return sendResponse(c, 200, newResponseV2(db, body, start, results))
+}
+
+// Builds a v2 response; the results are those of a successful transaction.
+func newResponseV2(db *db, body *request, start time.Time, results []responseItem) responseV2 {
+	ret := responseV2{
+		Version: protocolV2,
+		Success: results != nil,
+		Meta: responseMetaV2{
+			DbId:          db.Id,
+			ServerVersion: version,
+			DryRun:        body.DryRun,
+			ElapsedMicros: time.Since(start).Microseconds(),
+		},
+	}
+
+	if results != nil {
+		ret.Results = make([]responseItemV2, len(results))
+		for i := range results {
+			ret.Results[i] = responseItemV2{responseItem: results[i], ElapsedMicros: results[i].elapsed.Microseconds()}
+			if results[i].Error != "" {
+				ret.Results[i].Error = newErrorV2(results[i].errCode, results[i].Error, i)
+			}
+		}
 	}
+	return ret
 }
@@ -0,0 +1,363 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	mllog "github.com/proofrock/go-mylittlelogger"
+	"github.com/wI2L/jettison"
+)
+
+const (
+	wsActionExec        = "exec"
+	wsActionBegin       = "begin"
+	wsActionCommit      = "commit"
+	wsActionRollback    = "rollback"
+	wsActionSubscribe   = "subscribe"
+	wsActionUnsubscribe = "unsubscribe"
+)
+
+// A WebSocket connection is a session with a database. The client sends
+// messages with the same format of the requests to the POST endpoint, with
+// an action (default: "exec") and a correlation id, that is returned in the
+// response so that the client can send several messages without waiting.
+// The messages are served in order.
+//
+// With the actions "begin", "commit" and "rollback" the session can open
+// an interactive transaction, that then hosts the "exec"s until it ends.
+// With "subscribe" it receives the events of the change feed.
+type wsSession struct {
+	Conn          *websocket.Conn
+	Db            *db
+	Authenticated bool
+	TxId          string // of the interactive transaction, if any
+	Subscriber    *changeSubscriber
+	SubMutex      sync.Mutex // guards Subscriber, that the feed can drop
+	WriteMutex    sync.Mutex // serializes the writes on the connection
+}
+
+// Only lets WebSocket upgrades pass
+func wsUpgradeHandler(c *fiber.Ctx) error {
+	if websocket.IsWebSocketUpgrade(c) {
+		return c.Next()
+	}
+	return fiber.ErrUpgradeRequired
+}
+
+// Returns the configuration of the WebSocket for a database, checking the
+// origin as CORS would.
+func wsConfig(db *db) websocket.Config {
+	var ret websocket.Config
+	if db.CORSOrigin != "" {
+		for _, origin := range strings.Split(db.CORSOrigin, ",") {
+			ret.Origins = append(ret.Origins, strings.TrimSpace(origin))
+		}
+	}
+	return ret
+}
+
+func wsHandler(databaseId string) func(conn *websocket.Conn) {
+	return func(conn *websocket.Conn) {
+		db, err := lookupDb(databaseId)
+		if err != nil {
+			return
+		}
+
+		sess := &wsSession{
+			Conn: conn,
+			Db:   &db,
+			// HTTP auth, if configured, was performed at upgrade
+			Authenticated: db.Auth == nil || strings.ToUpper(db.Auth.Mode) != authModeInline,
+		}
+		defer sess.close()
+
+		for {
+			_, bs, err := conn.ReadMessage()
+			if err != nil {
+				return // connection closed
+			}
+
+			var msg wsRequest
+			if err := json.Unmarshal(bs, &msg); err != nil {
+				sess.write(wsResponseFromError(nil, newWSErrorf(-1, fiber.StatusBadRequest, "in parsing message: %s", err.Error())))
+				continue
+			}
+
+			if !sess.Authenticated {
+				if err := sess.authenticate(&msg.request); err != nil {
+					// The credentials are checked only once, the connection is closed
+					sess.write(wsResponseFromError(msg.Id, err))
+					return
+				}
+			}
+
+			sess.serve(&msg)
+		}
+	}
+}
+
+// Checks the INLINE credentials in the first message of the session
+func (sess *wsSession) authenticate(body *request) error {
+	if err := lockDb(sess.Db); err != nil {
+		return err
+	}
+	defer sess.Db.Mutex.Unlock()
+
+	if err := ckInlineAuth(sess.Db, body); err != nil {
+		return err
+	}
+	sess.Authenticated = true
+	return nil
+}
+
+// Serves a message, writing the response
+func (sess *wsSession) serve(msg *wsRequest) {
+	action := strings.ToLower(msg.Action)
+	if action == "" {
+		action = wsActionExec
+	}
+
+	switch action {
+	case wsActionExec:
+		results, err := sess.exec(&msg.request)
+		if err != nil {
+			sess.write(wsResponseFromError(msg.Id, err))
+			return
+		}
+		sess.write(wsResponse{Id: msg.Id, Success: true, TxId: sess.TxId, Results: results})
+	case wsActionBegin:
+		if err := sess.begin(); err != nil {
+			sess.write(wsResponseFromError(msg.Id, err))
+			return
+		}
+		sess.write(wsResponse{Id: msg.Id, Success: true, TxId: sess.TxId})
+	case wsActionCommit, wsActionRollback:
+		txId := sess.TxId
+		if err := sess.end(action == wsActionCommit); err != nil {
+			sess.write(wsResponseFromError(msg.Id, err))
+			return
+		}
+		sess.write(wsResponse{Id: msg.Id, Success: true, TxId: txId})
+	case wsActionSubscribe:
+		// The response is written before the events
+		if err := sess.subscribe(msg); err != nil {
+			sess.write(wsResponseFromError(msg.Id, err))
+		}
+	case wsActionUnsubscribe:
+		if !sess.unsubscribe() {
+			sess.write(wsResponseFromError(msg.Id, newWSError(-1, fiber.StatusBadRequest, "no subscription in this session")))
+			return
+		}
+		sess.write(wsResponse{Id: msg.Id, Success: true})
+	default:
+		sess.write(wsResponseFromError(msg.Id, newWSErrorf(-1, fiber.StatusBadRequest, "unknown action '%s'", msg.Action)))
+	}
+}
+
+// Subscribes the session to the change feed; the events are sent as messages
+// with the id of the subscription, until the session unsubscribes or is closed.
+func (sess *wsSession) subscribe(msg *wsRequest) error {
+	if sess.Db.ChangeFeed == nil {
+		return newWSError(-1, fiber.StatusBadRequest, "the change feed is not enabled for this database")
+	}
+
+	sess.SubMutex.Lock()
+	defer sess.SubMutex.Unlock()
+
+	if sess.Subscriber != nil {
+		return newWSError(-1, fiber.StatusBadRequest, "already subscribed")
+	}
+
+	sub, backlog, gap := sess.Db.ChangeFeed.subscribe(msg.Tables, msg.LastEventId)
+	sess.Subscriber = sub
+
+	sess.write(wsResponse{Id: msg.Id, Success: true})
+
+	go func() {
+		if gap {
+			sess.write(wsResponse{Id: msg.Id, Success: true, Reset: true})
+		}
+		for i := range backlog {
+			sess.write(wsResponse{Id: msg.Id, Success: true, Event: &backlog[i]})
+		}
+		for ce := range sub.Ch {
+			sess.write(wsResponse{Id: msg.Id, Success: true, Event: &ce})
+		}
+
+		// If the session didn't unsubscribe, the feed dropped the subscriber
+		// (e.g. because it's too slow); the client can subscribe again, with
+		// the ID of the last event it received.
+		sess.SubMutex.Lock()
+		defer sess.SubMutex.Unlock()
+		if sess.Subscriber == sub {
+			sess.Subscriber = nil
+			sess.write(wsResponseFromError(msg.Id, newWSError(-1, fiber.StatusServiceUnavailable, "the subscription was dropped")))
+		}
+	}()
+
+	return nil
+}
+
+// Ends the subscription, if any; tells if there was one
+func (sess *wsSession) unsubscribe() bool {
+	sess.SubMutex.Lock()
+	defer sess.SubMutex.Unlock()
+
+	sub := sess.Subscriber
+	if sub == nil {
+		return false
+	}
+	// Cleared first, so that the forwarding goroutine knows it's not dropped
+	sess.Subscriber = nil
+	sess.Db.ChangeFeed.unsubscribe(sub)
+	return true
+}
+
+// Executes the items of a message, in the interactive transaction if one is
+// open, otherwise in a transaction of their own.
+func (sess *wsSession) exec(body *request) ([]responseItem, error) {
+	if len(body.Transaction) == 0 {
+		return nil, newWSError(-1, fiber.StatusBadRequest, "missing statements list ('transaction' node)")
+	}
+
+	if err := ckRequestOptions(body); err != nil {
+		return nil, err
+	}
+
+	if body.ResultFormat != nil &&
+		(strings.EqualFold(*body.ResultFormat, resultFormatNDJSONStream) || strings.EqualFold(*body.ResultFormat, resultFormatCSV)) {
+		return nil, newWSErrorf(-1, fiber.StatusBadRequest, "result format '%s' is not supported over WebSocket", *body.ResultFormat)
+	}
+
+	if body.Transaction[0].PageSize != 0 {
+		return nil, newWSError(0, fiber.StatusBadRequest, "cursors are not supported over WebSocket")
+	}
+
+	if body.Version == protocolV2 {
+		return nil, newWSError(-1, fiber.StatusBadRequest, "version 2 of the protocol is not supported over WebSocket")
+	}
+
+	if body.IdempotencyKey != "" {
+		return nil, newWSError(-1, fiber.StatusBadRequest, "idempotency keys are not supported over WebSocket")
+	}
+
+	if sess.TxId != "" {
+		itx, err := lockInteractiveTx(sess.Db, sess.TxId)
+		if err != nil {
+			sess.TxId = ""
+			return nil, err
+		}
+		defer itx.Mutex.Unlock()
+
+		results, err := itx.processBatch(body)
+		if itx.Closed {
+			sess.TxId = ""
+		}
+		return results, err
+	}
+
+	// Execute non-concurrently
+	if err := lockDb(sess.Db); err != nil {
+		return nil, err
+	}
+	defer sess.Db.Mutex.Unlock()
+
+	return runTransaction(sess.Db, body, nil)
+}
+
+// Opens an interactive transaction for the session
+func (sess *wsSession) begin() error {
+	if !sess.Db.InteractiveTx {
+		return newWSError(-1, fiber.StatusBadRequest, "interactive transactions are not enabled for this database")
+	}
+
+	if sess.TxId != "" {
+		return newWSError(-1, fiber.StatusBadRequest, "a transaction is already open in this session")
+	}
+
+	// See beginTxHandler()
+	if err := lockDb(sess.Db); err != nil {
+		return err
+	}
+
+	itx, err := beginInteractiveTx(sess.Db, "")
+	if err != nil {
+		sess.Db.Mutex.Unlock()
+		return err
+	}
+
+	sess.TxId = itx.Id
+	return nil
+}
+
+// Commits or rolls back the interactive transaction of the session
+func (sess *wsSession) end(commit bool) error {
+	if sess.TxId == "" {
+		return newWSError(-1, fiber.StatusBadRequest, "no transaction is open in this session")
+	}
+
+	itx, err := lockInteractiveTx(sess.Db, sess.TxId)
+	sess.TxId = ""
+	if err != nil {
+		return err
+	}
+	defer itx.Mutex.Unlock()
+
+	if err := itx.end(commit); err != nil {
+		return newWSError(-1, fiber.StatusInternalServerError, err.Error())
+	}
+	return nil
+}
+
+// Called when the connection is closed. A transaction left open is rolled back.
+func (sess *wsSession) close() {
+	if sess.TxId != "" {
+		sess.end(false)
+	}
+	sess.unsubscribe()
+}
+
+func (sess *wsSession) write(resp wsResponse) {
+	bs, err := jettison.Marshal(resp)
+	if err != nil {
+		mllog.Errorf("in encoding a WebSocket message: %s", err.Error())
+		return
+	}
+
+	sess.WriteMutex.Lock()
+	defer sess.WriteMutex.Unlock()
+
+	if err := sess.Conn.WriteMessage(websocket.TextMessage, bs); err != nil {
+		mllog.Errorf("in writing a WebSocket message: %s", err.Error())
+	}
+}
+
+func wsResponseFromError(id json.RawMessage, err error) wsResponse {
+	ret := wsResponse{Id: id, Success: false, Error: capitalize(err.Error())}
+	if wse, ok := err.(wsError); ok {
+		ret.Code = wse.Code
+		if wse.RequestIdx >= 0 {
+			ret.RequestIdx = &wse.RequestIdx
+		}
+	}
+	return ret
+}
@@ -0,0 +1,254 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+func wsDial(databaseId string, t *testing.T) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:12321/"+databaseId+"/ws", nil)
+	if err != nil {
+		t.Error("could not connect:", err)
+		return nil
+	}
+	return conn
+}
+
+func wsCall(conn *websocket.Conn, msg wsRequest, t *testing.T) wsResponse {
+	if err := conn.WriteJSON(msg); err != nil {
+		t.Error("could not send:", err)
+		return wsResponse{}
+	}
+	return wsRead(conn, t)
+}
+
+func wsRead(conn *websocket.Conn, t *testing.T) wsResponse {
+	var ret wsResponse
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&ret); err != nil {
+		t.Error("could not receive:", err)
+	}
+	return ret
+}
+
+func TestWSSetup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:            "ws",
+				Path:          ":memory:",
+				WebSocket:     true,
+				InteractiveTx: true,
+				InitStatements: []string{
+					"CREATE TABLE T (ID INT PRIMARY KEY, VAL TEXT)",
+				},
+			},
+			{
+				Id:        "wsauth",
+				Path:      ":memory:",
+				WebSocket: true,
+				Auth: &authr{
+					Mode: "INLINE",
+					ByCredentials: []credentialsCfg{
+						{
+							User:     "pietro",
+							Password: "hey",
+						},
+					},
+				},
+			},
+			{
+				Id:   "nows",
+				Path: ":memory:",
+			},
+		},
+	}
+	// With keep alive off, the server would answer the upgrade with "Connection: close"
+	go launch(cfg, false)
+
+	time.Sleep(time.Second)
+}
+
+func TestWSExec(t *testing.T) {
+	conn := wsDial("ws", t)
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+
+	// Pipelined: sends both, then reads the responses
+	conn.WriteJSON(wsRequest{Id: json.RawMessage(`1`), request: request{Transaction: []requestItem{{Statement: "INSERT INTO T VALUES (1, 'ONE')"}}}})
+	conn.WriteJSON(wsRequest{Id: json.RawMessage(`"two"`), request: request{Transaction: []requestItem{{Query: "SELECT VAL FROM T WHERE ID = 1"}}}})
+
+	res := wsRead(conn, t)
+	if !res.Success || string(res.Id) != `1` || *res.Results[0].RowsUpdated != 1 {
+		t.Error("wrong response to the first message")
+		return
+	}
+
+	res = wsRead(conn, t)
+	if !res.Success || string(res.Id) != `"two"` || getDefault[string](res.Results[0].ResultSet[0], "VAL") != "ONE" {
+		t.Error("wrong response to the second message")
+		return
+	}
+
+	// A failure is reported, and the connection stays open
+	res = wsCall(conn, wsRequest{Id: json.RawMessage(`3`), request: request{Transaction: []requestItem{{Statement: "INSERT INTO T VALUES (1, 'ONE')"}}}}, t)
+	if res.Success || string(res.Id) != `3` || res.Code != 500 || res.RequestIdx == nil || *res.RequestIdx != 0 {
+		t.Error("the failure was not reported")
+		return
+	}
+
+	res = wsCall(conn, wsRequest{Id: json.RawMessage(`4`), Action: "dance"}, t)
+	if res.Success || res.Code != 400 {
+		t.Error("an unknown action was accepted")
+		return
+	}
+
+	res = wsCall(conn, wsRequest{Id: json.RawMessage(`5`), request: request{IdempotencyKey: "k", Transaction: []requestItem{{Query: "SELECT 1"}}}}, t)
+	if res.Success || res.Code != 400 {
+		t.Error("an idempotency key was accepted")
+	}
+}
+
+func TestWSTransaction(t *testing.T) {
+	conn := wsDial("ws", t)
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+
+	res := wsCall(conn, wsRequest{Action: wsActionBegin}, t)
+	if !res.Success || res.TxId == "" {
+		t.Error("could not begin:", res.Error)
+		return
+	}
+
+	res = wsCall(conn, wsRequest{request: request{Transaction: []requestItem{{Statement: "INSERT INTO T VALUES (2, 'TWO')"}}}}, t)
+	if !res.Success {
+		t.Error("insert failed:", res.Error)
+		return
+	}
+
+	res = wsCall(conn, wsRequest{Action: wsActionRollback}, t)
+	if !res.Success {
+		t.Error("rollback failed:", res.Error)
+		return
+	}
+
+	res = wsCall(conn, wsRequest{request: request{Transaction: []requestItem{{Query: "SELECT COUNT(1) AS C FROM T WHERE ID = 2"}}}}, t)
+	if !res.Success || getDefault[float64](res.Results[0].ResultSet[0], "C") != 0 {
+		t.Error("the insert was not rolled back")
+		return
+	}
+
+	res = wsCall(conn, wsRequest{Action: wsActionCommit}, t)
+	if res.Success {
+		t.Error("committed without a transaction")
+		return
+	}
+
+	// A transaction left open is rolled back when the connection closes
+	res = wsCall(conn, wsRequest{Action: wsActionBegin}, t)
+	if !res.Success {
+		t.Error("could not begin:", res.Error)
+		return
+	}
+	res = wsCall(conn, wsRequest{request: request{Transaction: []requestItem{{Statement: "INSERT INTO T VALUES (3, 'THREE')"}}}}, t)
+	if !res.Success {
+		t.Error("insert failed:", res.Error)
+		return
+	}
+	conn.Close()
+
+	// The server notices the close asynchronously; meanwhile, the database is held
+	var code int
+	var ret response
+	for i := 0; i < 20; i++ {
+		if code, _, ret = call("ws", request{Transaction: []requestItem{{Query: "SELECT COUNT(1) AS C FROM T WHERE ID = 3"}}}, t); code != 409 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if code != 200 || getDefault[float64](ret.Results[0].ResultSet[0], "C") != 0 {
+		t.Error("the insert was not rolled back")
+	}
+}
+
+func TestWSAuth(t *testing.T) {
+	conn := wsDial("wsauth", t)
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+
+	res := wsCall(conn, wsRequest{request: request{Credentials: &credentials{User: "pietro", Password: "hey"}, Transaction: []requestItem{{Query: "SELECT 1"}}}}, t)
+	if !res.Success {
+		t.Error("authentication failed:", res.Error)
+		return
+	}
+
+	// Authenticated once for the whole connection
+	res = wsCall(conn, wsRequest{request: request{Transaction: []requestItem{{Query: "SELECT 1"}}}}, t)
+	if !res.Success {
+		t.Error("the session is not authenticated:", res.Error)
+	}
+}
+
+func TestWSAuthKO(t *testing.T) {
+	conn := wsDial("wsauth", t)
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+
+	res := wsCall(conn, wsRequest{request: request{Credentials: &credentials{User: "pietro", Password: "ho"}, Transaction: []requestItem{{Query: "SELECT 1"}}}}, t)
+	if res.Success || res.Code != 401 {
+		t.Error("authentication succeeded")
+		return
+	}
+
+	// The connection was closed
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("the connection is still open")
+	}
+}
+
+func TestWSNotEnabled(t *testing.T) {
+	if _, resp, err := websocket.DefaultDialer.Dial("ws://localhost:12321/nows/ws", nil); err == nil || resp == nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		t.Error("WebSocket should not be enabled")
+	}
+
+	resp, err := http.Get("http://localhost:12321/ws/ws")
+	if err != nil || resp.StatusCode != http.StatusUpgradeRequired {
+		t.Error("a plain GET should not be accepted")
+	}
+}
+
+func TestWSTeardown(t *testing.T) {
+	time.Sleep(time.Second)
+	Shutdown()
+}
@@ -22,10 +22,12 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/basicauth"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -106,6 +108,11 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 	// See the comments to errHandler() to see why.
 	app.Use(recover.New())
 
+	if len(cfg.Compression) > 0 {
+		app.Use(compressionMiddleware(cfg.Compression, cfg.CompressionMinSize))
+		mllog.StdOutf("- Compression enabled (%s), for responses of at least %d bytes", strings.Join(cfg.Compression, ", "), cfg.CompressionMinSize)
+	}
+
 	// Later on, for each file created there will be a defer to remove it, unless this
 	// guard is turned off
 	var filesToDelete []string
@@ -147,6 +154,12 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 		// Is the database new? Later I'll have to create the InitStatements
 		toCreate := isMemory || !fileExists(database.Path)
 
+		txMode, err := parseTxMode(database.TxMode)
+		if err != nil {
+			mllog.Fatalf("for db '%s', %s", database.Id, err.Error())
+		}
+		database.TxMode = txMode
+
 		connString := database.Path
 		var options []string
 		if database.ReadOnly {
@@ -156,6 +169,12 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 		if !database.DisableWALMode {
 			options = append(options, "_pragma=journal_mode(WAL)")
 		}
+		if database.BusyTimeoutMillis > 0 {
+			options = append(options, fmt.Sprintf("_pragma=busy_timeout(%d)", database.BusyTimeoutMillis))
+		}
+		if txMode != "" {
+			options = append(options, "_txlock="+txMode)
+		}
 		if len(options) > 0 {
 			connString = connString + "?" + strings.Join(options, "&")
 		}
@@ -188,6 +207,96 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 			mllog.StdOut("  + Strictly using only stored statements")
 		}
 
+		if database.InteractiveTxIdleSecs < 0 {
+			mllog.Fatalf("for db '%s', interactiveTxIdleSecs cannot be negative", database.Id)
+		} else if database.InteractiveTxIdleSecs == 0 {
+			database.InteractiveTxIdleSecs = defaultInteractiveTxIdleSecs
+		}
+
+		if database.InteractiveTxMaxSecs < 0 {
+			mllog.Fatalf("for db '%s', interactiveTxMaxSecs cannot be negative", database.Id)
+		} else if database.InteractiveTxMaxSecs == 0 {
+			database.InteractiveTxMaxSecs = defaultInteractiveTxMaxSecs
+		}
+
+		if database.InteractiveTx {
+			mllog.StdOutf("  + Interactive transactions enabled, idle timeout %ds, max duration %ds", database.InteractiveTxIdleSecs, database.InteractiveTxMaxSecs)
+		}
+
+		if database.WebSocket {
+			mllog.StdOut("  + WebSocket enabled")
+		}
+
+		if database.TableRoutes {
+			if database.UseOnlyStoredStatements {
+				mllog.Fatalf("for db '%s', table routes cannot be enabled when using only stored statements", database.Id)
+			}
+			mllog.StdOut("  + REST routes for the tables enabled")
+		}
+
+		if database.SchemaRoute {
+			mllog.StdOut("  + Schema introspection enabled")
+		}
+
+		if txMode != "" && txMode != txModeDeferred {
+			mllog.StdOutf("  + Transactions in %s mode", txMode)
+		}
+
+		if database.BusyTimeoutMillis < 0 {
+			mllog.Fatalf("for db '%s', busyTimeoutMillis cannot be negative", database.Id)
+		} else if database.BusyTimeoutMillis > 0 {
+			mllog.StdOutf("  + Busy timeout of %dms", database.BusyTimeoutMillis)
+		}
+
+		if database.BusyRetries < 0 {
+			mllog.Fatalf("for db '%s', busyRetries cannot be negative", database.Id)
+		} else if database.BusyRetries > 0 {
+			mllog.StdOutf("  + Retrying up to %d times if busy", database.BusyRetries)
+		}
+
+		if database.IdempotencyRetentionSecs < 0 {
+			mllog.Fatalf("for db '%s', idempotencyRetentionSecs cannot be negative", database.Id)
+		} else if database.IdempotencyRetentionSecs == 0 {
+			database.IdempotencyRetentionSecs = defaultIdempotencyRetentionSecs
+		}
+
+		if database.Idempotency {
+			if database.ReadOnly {
+				mllog.Fatalf("for db '%s', idempotency keys are not possible on a read only database", database.Id)
+			}
+			mllog.StdOutf("  + Idempotency keys enabled, retention %ds", database.IdempotencyRetentionSecs)
+		}
+
+		if database.CursorIdleSecs < 0 {
+			mllog.Fatalf("for db '%s', cursorIdleSecs cannot be negative", database.Id)
+		} else if database.CursorIdleSecs == 0 {
+			database.CursorIdleSecs = defaultCursorIdleSecs
+		}
+
+		if database.MaxCursors < 0 {
+			mllog.Fatalf("for db '%s', maxCursors cannot be negative", database.Id)
+		} else if database.MaxCursors == 0 {
+			database.MaxCursors = defaultMaxCursors
+		}
+
+		if database.TimeoutMillis < 0 {
+			mllog.Fatalf("for db '%s', timeoutMillis cannot be negative", database.Id)
+		} else if database.TimeoutMillis > 0 {
+			mllog.StdOutf("  + Requests time out after %dms", database.TimeoutMillis)
+		}
+
+		if database.MaxRows < 0 {
+			mllog.Fatalf("for db '%s', maxRows cannot be negative", database.Id)
+		} else if database.MaxRows > 0 {
+			if database.FailOnMaxRows {
+				mllog.StdOutf("  + Queries fail if returning more than %d rows", database.MaxRows)
+			} else {
+				mllog.StdOutf("  + Query results are truncated at %d rows", database.MaxRows)
+			}
+		} else if database.FailOnMaxRows {
+			mllog.Fatalf("for db '%s', failOnMaxRows is specified but maxRows is not", database.Id)
+		}
+
 		// Creates the mutex to be used to serialize the waiting time after a failed auth
 		var mutex sync.Mutex
 		database.Mutex = &mutex
@@ -204,6 +313,9 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 
 		if len(database.StoredStatsMap) > 0 {
 			mllog.StdOutf("  + With %d stored statements", len(database.StoredStatsMap))
+			if numGet := countGetStatements(&database); numGet > 0 {
+				mllog.StdOutf("  + %d of them callable with GET", numGet)
+			}
 		} else if database.UseOnlyStoredStatements {
 			mllog.Fatalf("for db '%s', specified to use only stored statements but no one is provided", database.Id)
 		}
@@ -238,6 +350,28 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 			mllog.Fatalf("in opening connection to %s: %s", database.Id, err.Error())
 		}
 
+		if database.Idempotency {
+			if err := initIdempotency(&database); err != nil {
+				mllog.Fatalf("in setting up the idempotency keys of %s: %s", database.Id, err.Error())
+			}
+		}
+
+		if database.ChangeFeedBufferSize < 0 {
+			mllog.Fatalf("for db '%s', changeFeedBufferSize cannot be negative", database.Id)
+		} else if database.ChangeFeedBufferSize == 0 {
+			database.ChangeFeedBufferSize = defaultChangeFeedBufferSize
+		}
+
+		if database.EnableChangeFeed {
+			if database.ReadOnly {
+				mllog.Fatalf("for db '%s', a change feed is not possible on a read only database", database.Id)
+			}
+			if database.ChangeFeed, err = newChangeFeed(&database); err != nil {
+				mllog.Fatalf("in setting up the change feed of %s: %s", database.Id, err.Error())
+			}
+			mllog.StdOutf("  + Change feed enabled, buffer of %d events", database.ChangeFeedBufferSize)
+		}
+
 		// Parsing of the authentication
 		if database.Auth != nil {
 			parseAuth(&database)
@@ -261,6 +395,15 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 		dbs[database.Id] = database
 	}
 
+	if cfg.OpenAPI {
+		doc, err := genOpenAPI(dbs)
+		if err != nil {
+			mllog.Fatalf("generating the OpenAPI document: %s", err.Error())
+		}
+		app.Get(openAPIPath, openAPIHandler(doc))
+		mllog.StdOutf("- Serving the OpenAPI document at %s", openAPIPath)
+	}
+
 	if cfg.ServeDir != nil {
 		app.Static("", *cfg.ServeDir, fiber.Static{
 			ByteRange: true,
@@ -277,11 +420,12 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 	for id := range dbs {
 		db := dbs[id]
 
+		// The middlewares, to put before every handler of this database
 		var handlers []fiber.Handler
 
 		if db.CORSOrigin != "" {
 			handlers = append(handlers, cors.New(cors.Config{
-				AllowMethods: "POST,OPTIONS",
+				AllowMethods: "GET,POST,PATCH,DELETE,OPTIONS",
 				AllowOrigins: db.CORSOrigin,
 			}))
 		}
@@ -291,9 +435,12 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 				Authorizer: func(user, password string) bool {
 					if err := applyAuthCreds(&db, user, password); err != nil {
 						// When unauthenticated waits for 1s, and doesn't parallelize, to hinder brute force attacks
-						db.Mutex.Lock()
-						time.Sleep(time.Second)
-						db.Mutex.Unlock()
+						if lockDb(&db) == nil {
+							time.Sleep(time.Second)
+							db.Mutex.Unlock()
+						} else {
+							time.Sleep(time.Second)
+						}
 						mllog.Errorf("credentials not valid for user '%s'", user)
 						return false
 					}
@@ -308,18 +455,58 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 			}))
 		}
 
-		handlers = append(handlers, handler(db.Id))
-
 		// Fix for Issue #57: Support Unicode database names in HTTP routes
 		// URL-encode the database ID for route registration to handle Unicode characters.
 		// When clients send requests with Unicode (e.g., "数据库"), browsers/curl will
 		// URL-encode it (e.g., "%E6%95%B0%E6%8D%AE%E5%BA%93"). We must register routes
 		// with the encoded form so Fiber can match incoming requests.
 		encodedId := url.PathEscape(db.Id)
-		app.Post(fmt.Sprintf("/%s", encodedId), handlers...)
 
-		if db.CORSOrigin != "" {
-			app.Options(fmt.Sprintf("/%s", encodedId), handlers...)
+		route := func(method, path string, h fiber.Handler) {
+			path = fmt.Sprintf("/%s%s", encodedId, path)
+			app.Add(method, path, slices.Concat(handlers, []fiber.Handler{h})...)
+			if db.CORSOrigin != "" {
+				app.Options(path, slices.Concat(handlers, []fiber.Handler{h})...)
+			}
+		}
+		post := func(path string, h fiber.Handler) { route(fiber.MethodPost, path, h) }
+		get := func(path string, h fiber.Handler) { route(fiber.MethodGet, path, h) }
+
+		if db.InteractiveTx {
+			post("/tx", beginTxHandler(db.Id))
+			post("/tx/:txId", txBatchHandler(db.Id))
+			post("/tx/:txId/commit", endTxHandler(db.Id, true))
+			post("/tx/:txId/rollback", endTxHandler(db.Id, false))
+		}
+
+		if db.WebSocket {
+			app.Get(fmt.Sprintf("/%s/ws", encodedId), slices.Concat(handlers, []fiber.Handler{wsUpgradeHandler, websocket.New(wsHandler(db.Id), wsConfig(&db))})...)
+		}
+
+		if db.EnableChangeFeed {
+			get("/events", eventsHandler(db.Id))
+		}
+
+		if db.TableRoutes {
+			get("/tables/:table", tableListHandler(db.Id))
+			get("/tables/:table/:pk", tableGetHandler(db.Id))
+			post("/tables/:table", tableInsertHandler(db.Id))
+			route(fiber.MethodPatch, "/tables/:table/:pk", tableUpdateHandler(db.Id))
+			route(fiber.MethodDelete, "/tables/:table/:pk", tableDeleteHandler(db.Id))
+		}
+
+		if db.SchemaRoute {
+			get("/schema", schemaHandler(db.Id))
+		}
+
+		post("/cursor/:cursorId", cursorPageHandler(db.Id))
+		post("/cursor/:cursorId/close", cursorCloseHandler(db.Id))
+
+		post("", handler(db.Id))
+
+		// Last, so that the other GET routes have precedence
+		if countGetStatements(&db) > 0 {
+			get("/:statementId", getHandler(db.Id))
 		}
 	}
 
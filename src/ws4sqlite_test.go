@@ -17,9 +17,12 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"os"
 	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -60,8 +63,8 @@ func Shutdown() {
 	}
 }
 
-// call with basic auth support
-func callBA(databaseId string, req request, user, password string, t *testing.T) (int, string, response) {
+// call with basic auth support, doesn't parse the response
+func callRawBA(databaseId string, req request, user, password string, t *testing.T) (int, []byte) {
 	json_data, err := json.Marshal(req)
 	if err != nil {
 		t.Error(err)
@@ -82,6 +85,13 @@ func callBA(databaseId string, req request, user, password string, t *testing.T)
 		t.Error(errs[0])
 	}
 
+	return code, bodyBytes
+}
+
+// call with basic auth support
+func callBA(databaseId string, req request, user, password string, t *testing.T) (int, string, response) {
+	code, bodyBytes := callRawBA(databaseId, req, user, password, t)
+
 	var res response
 	if err := json.Unmarshal(bodyBytes, &res); code == 200 && err != nil {
 		println(string(bodyBytes))
@@ -545,6 +555,685 @@ func TestArrayParams(t *testing.T) {
 	}
 }
 
+var ndjsonResults string = "ndjson-stream"
+
+func TestNDJSONStream(t *testing.T) {
+	req := request{
+		ResultFormat: &ndjsonResults,
+		Transaction: []requestItem{
+			{
+				Statement: "CREATE TABLE table_to_stream (id INT, val TEXT)",
+			},
+			{
+				Statement: "INSERT INTO table_to_stream VALUES (:id, :val)",
+				ValuesBatch: []json.RawMessage{
+					mkRaw(map[string]interface{}{"id": 1, "val": "ONE"}),
+					mkRaw(map[string]interface{}{"id": 2, "val": "TWO"}),
+					mkRaw(map[string]interface{}{"id": 3, "val": "THREE"}),
+				},
+			},
+			{
+				Query: "SELECT * FROM table_to_stream ORDER BY id",
+			},
+			{
+				Statement: "DROP TABLE table_to_stream",
+			},
+		},
+	}
+	code, body := callRawBA("test", req, "", "", t)
+
+	if code != 200 {
+		t.Error("did not succeed")
+		return
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if len(lines) != 5 {
+		t.Error("expected 5 lines, got", len(lines))
+		return
+	}
+
+	var headers streamHeaders
+	if err := json.Unmarshal([]byte(lines[0]), &headers); err != nil || headers.RequestIdx != 2 || !slices.Equal(headers.ResultHeaders, []string{"id", "val"}) {
+		t.Error("wrong headers line")
+		return
+	}
+
+	for i := 1; i <= 3; i++ {
+		var row streamRow
+		if err := json.Unmarshal([]byte(lines[i]), &row); err != nil || row.RequestIdx != 2 || row.Row[0] != float64(i) {
+			t.Error("wrong row line", i)
+			return
+		}
+	}
+
+	var trailer streamTrailer
+	if err := json.Unmarshal([]byte(lines[4]), &trailer); err != nil || !trailer.Success || len(trailer.Results) != 4 {
+		t.Error("wrong trailer")
+		return
+	}
+
+	if len(trailer.Results[1].RowsUpdatedBatch) != 3 {
+		t.Error("req 1 inconsistent")
+	}
+
+	if trailer.Results[2].ResultSet != nil || !slices.Equal(trailer.Results[2].ResultHeaders, []string{"id", "val"}) {
+		t.Error("req 2 inconsistent")
+	}
+}
+
+func TestNDJSONStreamFail(t *testing.T) {
+	req := request{
+		ResultFormat: &ndjsonResults,
+		Transaction: []requestItem{
+			{
+				Statement: "CREATE TABLE table_to_stream (id INT, val TEXT)",
+			},
+			{
+				Query: "SELECT * FROM table_to_stream",
+			},
+			{
+				Query: "SELECT * FROM table_not_there",
+			},
+		},
+	}
+	code, body := callRawBA("test", req, "", "", t)
+
+	if code != 200 {
+		t.Error("did not succeed")
+		return
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if len(lines) != 2 {
+		t.Error("expected 2 lines, got", len(lines))
+		return
+	}
+
+	var trailer streamTrailer
+	if err := json.Unmarshal([]byte(lines[1]), &trailer); err != nil || trailer.Success || trailer.Results != nil || *trailer.RequestIdx != 2 || trailer.Error == "" {
+		t.Error("wrong trailer")
+		return
+	}
+
+	// The transaction was rolled back, so the table doesn't exist
+	req = request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT * FROM table_to_stream",
+			},
+		},
+	}
+	code, _, _ = call("test", req, t)
+
+	if code != 500 {
+		t.Error("did succeed, but shouldn't")
+	}
+}
+
+var csvResults string = "csv"
+
+func TestCSV(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			{
+				Statement: "CREATE TABLE table_for_csv (id INT, val TEXT, num REAL)",
+			},
+			{
+				Statement: "INSERT INTO table_for_csv VALUES (1, 'ONE', 1.5), (2, 'TWO, \"2\"', NULL)",
+			},
+		},
+	}
+	code, _, _ := call("test", req, t)
+
+	if code != 200 {
+		t.Error("did not succeed")
+		return
+	}
+
+	req = request{
+		ResultFormat: &csvResults,
+		Transaction: []requestItem{
+			{
+				Query: "SELECT * FROM table_for_csv ORDER BY id",
+			},
+		},
+	}
+	code, body := callRawBA("test", req, "", "", t)
+
+	if code != 200 {
+		t.Error("did not succeed")
+		return
+	}
+
+	if string(body) != "id,val,num\r\n1,ONE,1.5\r\n2,\"TWO, \"\"2\"\"\",\r\n" {
+		t.Error("wrong csv:", string(body))
+		return
+	}
+
+	req.CSVOptions = &csvOptions{Delimiter: ";", NoHeader: true}
+	code, body = callRawBA("test", req, "", "", t)
+
+	if code != 200 {
+		t.Error("did not succeed")
+		return
+	}
+
+	if string(body) != "1;ONE;1.5\r\n2;\"TWO, \"\"2\"\"\";\r\n" {
+		t.Error("wrong csv:", string(body))
+		return
+	}
+
+	req = request{
+		ResultFormat: &csvResults,
+		Transaction: []requestItem{
+			{
+				Query: "SELECT * FROM table_for_csv",
+			},
+			{
+				Statement: "DROP TABLE table_for_csv",
+			},
+		},
+	}
+	code, _ = callRawBA("test", req, "", "", t)
+
+	if code != 400 {
+		t.Error("did succeed, but shouldn't")
+		return
+	}
+
+	req = request{
+		Transaction: []requestItem{
+			{
+				Statement: "DROP TABLE table_for_csv",
+			},
+		},
+	}
+	code, _, _ = call("test", req, t)
+
+	if code != 200 {
+		t.Error("did not succeed")
+	}
+}
+
+func TestResultTypes(t *testing.T) {
+	req := request{
+		ResultTypes: true,
+		Transaction: []requestItem{
+			{
+				Statement: "CREATE TABLE table_with_types (a INTEGER, b REAL, c TEXT, d BLOB, e)",
+			},
+			{
+				Statement: "INSERT INTO table_with_types VALUES (1, 1.5, 'x', X'01', NULL), (2, NULL, 'y', NULL, 'z')",
+			},
+			{
+				Query: "SELECT * FROM table_with_types ORDER BY a",
+			},
+			{
+				Statement: "DROP TABLE table_with_types",
+			},
+		},
+	}
+	code, _, res := call("test", req, t)
+
+	if code != 200 {
+		t.Error("did not succeed")
+		return
+	}
+
+	if res.Results[1].ResultTypes != nil {
+		t.Error("statements shouldn't have types")
+		return
+	}
+
+	types := res.Results[2].ResultTypes
+	if len(types) != 5 {
+		t.Error("expected 5 result types")
+		return
+	}
+
+	expectedDeclared := []string{"INTEGER", "REAL", "TEXT", "BLOB", ""}
+	expectedClasses := [][]string{{"INTEGER"}, {"REAL", "NULL"}, {"TEXT"}, {"BLOB", "NULL"}, {"NULL", "TEXT"}}
+	for i := range types {
+		if types[i].DeclaredType != expectedDeclared[i] {
+			t.Error("wrong declared type for column", i, types[i].DeclaredType)
+		}
+		if !slices.Equal(types[i].StorageClasses, expectedClasses[i]) {
+			t.Error("wrong storage classes for column", i, types[i].StorageClasses)
+		}
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	blob := []byte{0, 1, 2, 0xfe, 0xff}
+	b64 := base64.StdEncoding.EncodeToString(blob)
+
+	req := request{
+		Transaction: []requestItem{
+			{
+				Statement: "CREATE TABLE table_with_blobs (id INT, data BLOB)",
+			},
+			{
+				Statement: "INSERT INTO table_with_blobs VALUES (:id, :data)",
+				Values: mkRaw(map[string]interface{}{
+					"id":   1,
+					"data": map[string]interface{}{"$blob": b64},
+				}),
+			},
+			{
+				Statement: "INSERT INTO table_with_blobs VALUES (?, ?)",
+				Values:    mkRaw([]interface{}{2, map[string]interface{}{"$blob": b64}}),
+			},
+			{
+				Query: "SELECT data, typeof(data) AS type FROM table_with_blobs ORDER BY id",
+			},
+		},
+	}
+	code, _, res := call("test", req, t)
+
+	if code != 200 {
+		t.Error("did not succeed")
+		return
+	}
+
+	for _, row := range res.Results[3].ResultSet {
+		if getDefault[string](row, "type") != "blob" || getDefault[string](row, "data") != b64 {
+			t.Error("blob not round-tripped")
+			return
+		}
+	}
+
+	for format, expected := range map[string]string{
+		"hex":    `"` + hex.EncodeToString(blob) + `"`,
+		"tagged": `{"$blob":"` + b64 + `"}`,
+	} {
+		req = request{
+			BlobFormat: &format,
+			Transaction: []requestItem{
+				{
+					Query: "SELECT data FROM table_with_blobs ORDER BY id",
+				},
+			},
+		}
+		code, _, res = call("test", req, t)
+
+		if code != 200 {
+			t.Error("did not succeed")
+			return
+		}
+
+		if data, _ := json.Marshal(getDefault[interface{}](res.Results[0].ResultSet[0], "data")); string(data) != expected {
+			t.Error("wrong blob with format", format)
+		}
+	}
+
+	wrongFormat := "base32"
+	req = request{
+		BlobFormat: &wrongFormat,
+		Transaction: []requestItem{
+			{
+				Query: "SELECT data FROM table_with_blobs",
+			},
+		},
+	}
+	code, _, _ = call("test", req, t)
+
+	if code != 400 {
+		t.Error("did succeed, but shouldn't")
+	}
+
+	req = request{
+		Transaction: []requestItem{
+			{
+				Statement: "INSERT INTO table_with_blobs VALUES (:id, :data)",
+				Values: mkRaw(map[string]interface{}{
+					"id":   3,
+					"data": map[string]interface{}{"$blob": "not base64!"},
+				}),
+			},
+		},
+	}
+	code, _, _ = call("test", req, t)
+
+	if code != 500 {
+		t.Error("did succeed, but shouldn't")
+	}
+
+	req = request{
+		Transaction: []requestItem{
+			{
+				Statement: "DROP TABLE table_with_blobs",
+			},
+		},
+	}
+	code, _, _ = call("test", req, t)
+
+	if code != 200 {
+		t.Error("did not succeed")
+	}
+}
+
+func TestPrecondition(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			{
+				Statement: "CREATE TABLE table_with_version (id INT PRIMARY KEY, val TEXT, version INT)",
+			},
+			{
+				Statement: "INSERT INTO table_with_version VALUES (1, 'ONE', 1)",
+			},
+		},
+	}
+	code, _, _ := call("test", req, t)
+
+	if code != 200 {
+		t.Error("did not succeed")
+		return
+	}
+
+	update := request{
+		Transaction: []requestItem{
+			{
+				Precondition: "SELECT 1 FROM table_with_version WHERE id = 1 AND version = :version",
+				Values:       mkRaw(map[string]interface{}{"version": 1}),
+			},
+			{
+				Statement: "UPDATE table_with_version SET val = :val, version = version + 1 WHERE id = 1",
+				Values:    mkRaw(map[string]interface{}{"val": "UNO"}),
+			},
+		},
+	}
+	code, _, res := call("test", update, t)
+
+	if code != 200 || !res.Results[0].Success || *res.Results[1].RowsUpdated != 1 {
+		t.Error("did not succeed")
+		return
+	}
+
+	// Same version, now stale
+	update.Transaction[1].Values = mkRaw(map[string]interface{}{"val": "EINS"})
+	code, body, _ := call("test", update, t)
+
+	if code != 412 {
+		t.Error("did succeed, but shouldn't")
+		return
+	}
+
+	var wse wsError
+	if err := json.Unmarshal([]byte(body), &wse); err != nil || wse.RequestIdx != 0 {
+		t.Error("wrong error")
+		return
+	}
+
+	req = request{
+		Transaction: []requestItem{
+			{
+				Precondition: "SELECT val = 'UNO' FROM table_with_version WHERE id = 1",
+			},
+			{
+				Precondition: "SELECT 0",
+				NoFail:       true,
+			},
+		},
+	}
+	code, _, _ = call("test", req, t)
+
+	if code != 400 {
+		t.Error("a noFail precondition was accepted")
+		return
+	}
+
+	req.Transaction[1] = requestItem{Statement: "DROP TABLE table_with_version"}
+	code, _, res = call("test", req, t)
+
+	if code != 200 || !res.Results[0].Success {
+		t.Error("the stale update was not rolled back")
+	}
+}
+
+func TestReferences(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			{
+				Statement: "CREATE TABLE parent_table (id INTEGER PRIMARY KEY, val TEXT)",
+			},
+			{
+				Statement: "CREATE TABLE child_table (parent_id INT, val TEXT)",
+			},
+			{
+				Statement: "INSERT INTO parent_table (val) VALUES ('P')",
+			},
+			{
+				Query: "SELECT id FROM parent_table WHERE val = 'P'",
+			},
+			{
+				Statement: "INSERT INTO child_table VALUES (:parent_id, :val)",
+				Values: mkRaw(map[string]interface{}{
+					"parent_id": map[string]interface{}{"$ref": "3.resultSet[0].id"},
+					"val":       "C1",
+				}),
+			},
+			{
+				Statement: "INSERT INTO child_table VALUES (?, ?)",
+				ValuesBatch: []json.RawMessage{
+					mkRaw([]interface{}{map[string]interface{}{"$ref": "3.resultSet[0].id"}, "C2"}),
+					mkRaw([]interface{}{map[string]interface{}{"$ref": "4.rowsUpdated"}, "C3"}),
+				},
+			},
+			{
+				Query: "SELECT p.val AS pval, c.parent_id, typeof(c.parent_id) AS type FROM child_table c LEFT JOIN parent_table p ON p.id = c.parent_id ORDER BY c.val",
+			},
+		},
+	}
+	code, body, res := call("test", req, t)
+
+	if code != 200 {
+		t.Error("did not succeed:", body)
+		return
+	}
+
+	rs := res.Results[6].ResultSet
+	if len(rs) != 3 {
+		t.Error("expected 3 children")
+		return
+	}
+	for i := range rs {
+		if getDefault[float64](rs[i], "parent_id") != 1 || getDefault[string](rs[i], "type") != "integer" {
+			t.Error("wrong reference for child", i)
+		}
+	}
+
+	for _, ref := range []string{"7.rowsUpdated", "2.resultSet[0].id", "2.rowsUpdated[0]", "2.rowsUpdated.x", "3.resultSet", "3.resultSet[1].id", "x.rowsUpdated", "3", "3.resultSet[0"} {
+		req = request{
+			Transaction: []requestItem{
+				{
+					Query: "SELECT 1",
+				},
+				{
+					Query: "SELECT 1",
+				},
+				{
+					Statement: "DELETE FROM child_table WHERE 0",
+				},
+				{
+					Query: "SELECT 1 AS id",
+				},
+				{
+					Query: "SELECT :id",
+					Values: mkRaw(map[string]interface{}{
+						"id": map[string]interface{}{"$ref": ref},
+					}),
+				},
+			},
+		}
+		code, _, _ = call("test", req, t)
+
+		if code != 400 {
+			t.Error("wrong reference accepted:", ref)
+		}
+	}
+
+	req = request{
+		Transaction: []requestItem{
+			{
+				Statement: "DROP TABLE parent_table",
+			},
+			{
+				Statement: "DROP TABLE child_table",
+			},
+		},
+	}
+	code, _, _ = call("test", req, t)
+
+	if code != 200 {
+		t.Error("did not succeed")
+	}
+}
+
+func TestReferencesBlob(t *testing.T) {
+	list := resultFormatList
+	for _, format := range []string{"", blobFormatBase64, blobFormatHex, blobFormatTagged} {
+		for _, resultFormat := range []*string{nil, &list} {
+			ref := "0.resultSet[0].b"
+			if resultFormat != nil {
+				ref = "0.resultSetList[0][0]"
+			}
+			req := request{
+				ResultFormat: resultFormat,
+				Transaction: []requestItem{
+					{
+						Query: "SELECT X'00FF10' AS b",
+					},
+					{
+						Query: "SELECT typeof(:b) AS t, hex(:b) AS h",
+						Values: mkRaw(map[string]interface{}{
+							"b": map[string]interface{}{"$ref": ref},
+						}),
+					},
+				},
+			}
+			if format != "" {
+				req.BlobFormat = &format
+			}
+			code, body, res := call("test", req, t)
+
+			if code != 200 {
+				t.Error("did not succeed:", body)
+				return
+			}
+
+			var typ, hx string
+			if resultFormat != nil {
+				typ, _ = res.Results[1].ResultSetList[0][0].(string)
+				hx, _ = res.Results[1].ResultSetList[0][1].(string)
+			} else {
+				typ = getDefault[string](res.Results[1].ResultSet[0], "t")
+				hx = getDefault[string](res.Results[1].ResultSet[0], "h")
+			}
+			if typ != "blob" || hx != "00FF10" {
+				t.Errorf("the BLOB was not bound as such, in format '%s': %s %s", format, typ, hx)
+			}
+		}
+	}
+}
+
+func TestLastInsertId(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			{
+				Statement: "CREATE TABLE table_with_autoinc (id INTEGER PRIMARY KEY AUTOINCREMENT, val TEXT)",
+			},
+			{
+				Statement: "INSERT INTO table_with_autoinc (val) VALUES ('ONE')",
+			},
+			{
+				Statement: "INSERT INTO table_with_autoinc (val) VALUES (?)",
+				ValuesBatch: []json.RawMessage{
+					mkRaw([]string{"TWO"}),
+					mkRaw([]string{"THREE"}),
+				},
+			},
+			{
+				Query: "SELECT val FROM table_with_autoinc WHERE id = :id",
+				Values: mkRaw(map[string]interface{}{
+					"id": map[string]interface{}{"$ref": "2.lastInsertIdBatch[1]"},
+				}),
+			},
+			{
+				Statement: "DROP TABLE table_with_autoinc",
+			},
+		},
+	}
+	code, _, res := call("test", req, t)
+
+	if code != 200 {
+		t.Error("did not succeed")
+		return
+	}
+
+	if *res.Results[1].LastInsertId != 1 {
+		t.Error("wrong lastInsertId")
+	}
+
+	if !slices.Equal(res.Results[2].LastInsertIdBatch, []int64{2, 3}) {
+		t.Error("wrong lastInsertIdBatch")
+	}
+
+	if getDefault[string](res.Results[3].ResultSet[0], "val") != "THREE" {
+		t.Error("wrong reference to lastInsertIdBatch")
+	}
+}
+
+func TestReturning(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			{
+				Statement: "CREATE TABLE table_returning (id INTEGER PRIMARY KEY, val TEXT)",
+			},
+			{
+				Statement: "INSERT INTO table_returning (val) VALUES ('ONE'), ('TWO') RETURNING id, val",
+			},
+			{
+				Statement: "INSERT INTO table_returning (val) VALUES (:val) returning id",
+				ValuesBatch: []json.RawMessage{
+					mkRaw(map[string]interface{}{"val": "THREE"}),
+					mkRaw(map[string]interface{}{"val": "FOUR"}),
+				},
+			},
+			{
+				Statement: "UPDATE table_returning SET val = 'RETURNING' WHERE id > 10",
+			},
+			{
+				Statement: "DROP TABLE table_returning",
+			},
+		},
+	}
+	code, _, res := call("test", req, t)
+
+	if code != 200 {
+		t.Error("did not succeed")
+		return
+	}
+
+	item := res.Results[1]
+	if *item.RowsUpdated != 2 || *item.LastInsertId != 2 || len(item.ResultSet) != 2 ||
+		getDefault[float64](item.ResultSet[1], "id") != 2 || getDefault[string](item.ResultSet[1], "val") != "TWO" {
+		t.Error("req 1 inconsistent")
+	}
+
+	item = res.Results[2]
+	if !slices.Equal(item.RowsUpdatedBatch, []int64{1, 1}) || !slices.Equal(item.LastInsertIdBatch, []int64{3, 4}) ||
+		len(item.ResultSetBatch) != 2 || getDefault[float64](item.ResultSetBatch[1][0], "id") != 4 {
+		t.Error("req 2 inconsistent")
+	}
+
+	// A false positive, but it must work anyway
+	item = res.Results[3]
+	if *item.RowsUpdated != 0 || len(item.ResultSet) != 0 {
+		t.Error("req 3 inconsistent")
+	}
+}
+
 // don't remove the file, we'll use it for the next tests for read-only
 func TestTeardown(t *testing.T) {
 	time.Sleep(time.Second)